@@ -2,4 +2,9 @@ module github.com/butuhanov/smo-helpers
 
 go 1.14
 
-require github.com/aws/aws-lambda-go v1.18.0
+require (
+	github.com/aws/aws-lambda-go v1.18.0
+	github.com/aws/aws-sdk-go v1.34.0
+	github.com/mattn/go-sqlite3 v1.14.0
+	gopkg.in/yaml.v2 v2.2.2
+)
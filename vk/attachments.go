@@ -0,0 +1,201 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Вложения записей и личных сообщений
+var forwardAttachments = envOr("FORWARD_ATTACHMENTS", "1") == "1" // Пересылать сообщения и прикладывать вложения к уведомлениям
+
+// attachment вложение; заполнено поле, соответствующее Type
+type attachment struct {
+	Type         string                  `json:"type"`
+	Photo        *photoAttachment        `json:"photo,omitempty"`
+	Video        *mediaAttachment        `json:"video,omitempty"`
+	Audio        *audioAttachment        `json:"audio,omitempty"`
+	Doc          *docAttachment          `json:"doc,omitempty"`
+	AudioMessage *audioMessageAttachment `json:"audio_message,omitempty"`
+	Sticker      *stickerAttachment      `json:"sticker,omitempty"`
+	Link         *linkAttachment         `json:"link,omitempty"`
+	Poll         *pollAttachment         `json:"poll,omitempty"`
+	Wall         *wallAttachment         `json:"wall,omitempty"`
+}
+
+// mediaAttachment общие поля медиавложений
+type mediaAttachment struct {
+	ID        int    `json:"id"`
+	OwnerID   int    `json:"owner_id"`
+	AccessKey string `json:"access_key"`
+	Title     string `json:"title"`
+}
+
+type photoAttachment struct {
+	mediaAttachment
+	Text  string `json:"text"`
+	Sizes []struct {
+		Type   string `json:"type"`
+		URL    string `json:"url"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	} `json:"sizes"`
+}
+
+type audioAttachment struct {
+	mediaAttachment
+	Artist string `json:"artist"`
+}
+
+type docAttachment struct {
+	mediaAttachment
+	Ext  string `json:"ext"`
+	URL  string `json:"url"`
+	Size int    `json:"size"`
+}
+
+type audioMessageAttachment struct {
+	mediaAttachment
+	Duration   int    `json:"duration"`
+	LinkMP3    string `json:"link_mp3"`
+	LinkOGG    string `json:"link_ogg"`
+	Transcript string `json:"transcript"`
+}
+
+type stickerAttachment struct {
+	ProductID int `json:"product_id"`
+	StickerID int `json:"sticker_id"`
+	Images    []struct {
+		URL    string `json:"url"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	} `json:"images"`
+}
+
+type linkAttachment struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
+
+type pollAttachment struct {
+	mediaAttachment
+	Question string `json:"question"`
+}
+
+type wallAttachment struct {
+	mediaAttachment
+	FromID int    `json:"from_id"`
+	ToID   int    `json:"to_id"`
+	Text   string `json:"text"`
+}
+
+// largestURL возвращает адрес самой большой копии фотографии
+func (p photoAttachment) largestURL() string {
+	url, best := "", 0
+	for _, s := range p.Sizes {
+		if s.Width*s.Height >= best {
+			url, best = s.URL, s.Width*s.Height
+		}
+	}
+	return url
+}
+
+// ref возвращает идентификатор вида photo<owner>_<id>_<access_key> для параметра attachment
+func (m mediaAttachment) ref(kind string) string {
+	ref := kind + strconv.Itoa(m.OwnerID) + "_" + strconv.Itoa(m.ID)
+	if m.AccessKey != "" {
+		ref += "_" + m.AccessKey
+	}
+	return ref
+}
+
+// Ref возвращает идентификатор вложения для повторной отправки или пустую строку,
+// если вложение нельзя приложить к сообщению (стикеры, голосовые сообщения, ссылки)
+func (a attachment) Ref() string {
+	switch {
+	case a.Photo != nil:
+		return a.Photo.ref("photo")
+	case a.Video != nil:
+		return a.Video.ref("video")
+	case a.Audio != nil:
+		return a.Audio.ref("audio")
+	case a.Doc != nil:
+		return a.Doc.ref("doc")
+	case a.Poll != nil:
+		return a.Poll.ref("poll")
+	case a.Wall != nil:
+		owner := a.Wall.OwnerID
+		if owner == 0 {
+			owner = a.Wall.ToID
+		}
+		return "wall" + strconv.Itoa(owner) + "_" + strconv.Itoa(a.Wall.ID)
+	}
+	return ""
+}
+
+// String описывает вложение для текста уведомления
+func (a attachment) String() string {
+	switch {
+	case a.Photo != nil:
+		if url := a.Photo.largestURL(); url != "" {
+			return "фото " + url
+		}
+		return "фото " + links.Photo(a.Photo.OwnerID, a.Photo.ID)
+	case a.Video != nil:
+		return "видео " + a.Video.Title + " " + links.Video(a.Video.OwnerID, a.Video.ID)
+	case a.Audio != nil:
+		return "аудиозапись " + a.Audio.Artist + " — " + a.Audio.Title
+	case a.Doc != nil:
+		url := a.Doc.URL
+		if url == "" {
+			url = links.Doc(a.Doc.OwnerID, a.Doc.ID)
+		}
+		return "документ " + a.Doc.Title + " " + url
+	case a.AudioMessage != nil:
+		text := "голосовое сообщение " + strconv.Itoa(a.AudioMessage.Duration) + " с " + a.AudioMessage.LinkMP3
+		if a.AudioMessage.Transcript != "" {
+			text += " «" + a.AudioMessage.Transcript + "»"
+		}
+		return text
+	case a.Sticker != nil:
+		if len(a.Sticker.Images) > 0 {
+			return "стикер " + a.Sticker.Images[len(a.Sticker.Images)-1].URL
+		}
+		return "стикер " + strconv.Itoa(a.Sticker.StickerID)
+	case a.Link != nil:
+		return "ссылка " + a.Link.Title + " " + a.Link.URL
+	case a.Poll != nil:
+		return "опрос «" + a.Poll.Question + "» " + links.Poll(a.Poll.OwnerID, a.Poll.ID)
+	case a.Wall != nil:
+		owner := a.Wall.OwnerID
+		if owner == 0 {
+			owner = a.Wall.ToID
+		}
+		return "запись " + links.WallPost(owner, a.Wall.ID)
+	}
+	return "вложение " + a.Type
+}
+
+// attachmentsText перечисляет вложения для текста уведомления
+func attachmentsText(list []attachment) string {
+	if len(list) == 0 {
+		return ""
+	}
+	var lines []string
+	for _, a := range list {
+		lines = append(lines, a.String())
+	}
+	return "\nВложения:\n" + strings.Join(lines, "\n")
+}
+
+// attachmentRefs возвращает идентификаторы вложений, которые можно приложить к уведомлению
+func attachmentRefs(list []attachment) []string {
+	var refs []string
+	for _, a := range list {
+		if ref := a.Ref(); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Отложенные публикации на стене сообщества по контент-плану
+var (
+	calendarFile  = os.Getenv("CALENDAR_FILE")               // Контент-план в формате YAML или CSV
+	calendarState = dataPath("calendar.json")                // Опубликованные, пропущенные и ошибочные записи плана
+	calendarGrace = envDuration("CALENDAR_GRACE", time.Hour) // Насколько запись может опоздать; более старые не публикуются, а только отмечаются
+)
+
+// calendarRecord состояние записи плана
+type calendarRecord struct {
+	PostID  int    `json:"post_id,omitempty"`
+	Overdue bool   `json:"overdue,omitempty"` // время публикации прошло больше calendarGrace назад, запись не опубликована
+	Error   string `json:"error,omitempty"`   // последняя ошибка, о которой уже сообщено
+}
+
+// UnmarshalJSON читает и прежний формат состояния, где для записи хранился только номер поста
+func (r *calendarRecord) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '{' {
+		return json.Unmarshal(b, &r.PostID)
+	}
+	type plain calendarRecord
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// handled запись опубликована или пропущена и больше не обрабатывается
+func (r calendarRecord) handled() bool {
+	return r.PostID != 0 || r.Overdue
+}
+
+// calendarEntry запись контент-плана
+type calendarEntry struct {
+	ID          string   `yaml:"id"`
+	Text        string   `yaml:"text"`
+	Attachments []string `yaml:"attachments"`
+	PublishAt   string   `yaml:"publish_at"`
+	Tags        []string `yaml:"tags"`
+
+	publishAt time.Time
+}
+
+// key возвращает идентификатор записи; если id не указан, он вычисляется из времени и текста
+func (e calendarEntry) key() string {
+	if e.ID != "" {
+		return e.ID
+	}
+	sum := sha1.Sum([]byte(e.PublishAt + "\n" + e.Text))
+	return hex.EncodeToString(sum[:8])
+}
+
+// message возвращает текст записи с хэштегами
+func (e calendarEntry) message() string {
+	if len(e.Tags) == 0 {
+		return e.Text
+	}
+	var tags []string
+	for _, t := range e.Tags {
+		tags = append(tags, "#"+strings.TrimPrefix(t, "#"))
+	}
+	return strings.TrimSpace(e.Text + "\n\n" + strings.Join(tags, " "))
+}
+
+// loadCalendar читает контент-план; формат определяется по расширению файла
+func loadCalendar(path string) ([]calendarEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []calendarEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		entries, err = parseCalendarCSV(strings.NewReader(string(b)))
+	default:
+		err = yaml.Unmarshal(b, &entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Dir(path)
+	for i := range entries {
+		// локальные файлы указываются относительно контент-плана
+		for j, a := range entries[i].Attachments {
+			if !vkAttachmentRe.MatchString(a) && !filepath.IsAbs(a) {
+				entries[i].Attachments[j] = filepath.Join(base, a)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// parseCalendarCSV разбирает CSV с заголовком publish_at,text,attachments,tags;
+// вложения и теги перечисляются через ";"
+func parseCalendarCSV(r io.Reader) ([]calendarEntry, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	splitField := func(s string) []string {
+		var list []string
+		for _, item := range strings.Split(s, ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+
+	var entries []calendarEntry
+	for _, record := range records[1:] {
+		entries = append(entries, calendarEntry{
+			ID:          field(record, "id"),
+			Text:        field(record, "text"),
+			Attachments: splitField(field(record, "attachments")),
+			PublishAt:   field(record, "publish_at"),
+			Tags:        splitField(field(record, "tags")),
+		})
+	}
+	return entries, nil
+}
+
+// vkAttachmentRe вложение, которое уже загружено во ВКонтакте
+var vkAttachmentRe = regexp.MustCompile(`^(photo|video|audio|doc|poll|market|wall|page|album)-?\d+_\d+(_[0-9a-zA-Z]+)?$`)
+
+// validate проверяет запись и разбирает время публикации
+func (e *calendarEntry) validate() error {
+	if e.PublishAt == "" {
+		return errors.New("не указано время публикации publish_at")
+	}
+	t, err := time.Parse(time.RFC3339, e.PublishAt)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02 15:04", e.PublishAt, time.Local)
+	}
+	if err != nil {
+		return fmt.Errorf("неверное время публикации %q", e.PublishAt)
+	}
+	e.publishAt = t
+
+	if strings.TrimSpace(e.Text) == "" && len(e.Attachments) == 0 {
+		return errors.New("нет ни текста, ни вложений")
+	}
+	if len(e.Attachments) > 10 {
+		return errors.New("больше 10 вложений")
+	}
+	for _, a := range e.Attachments {
+		if vkAttachmentRe.MatchString(a) {
+			continue
+		}
+		if err := validateUpload(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadAttachments загружает локальные файлы и заменяет их идентификаторами вложений
+func (e *calendarEntry) uploadAttachments(ctx context.Context) error {
+	for i, a := range e.Attachments {
+		if vkAttachmentRe.MatchString(a) {
+			continue
+		}
+		ref, err := vkAPI.UploadWall(ctx, a)
+		if err != nil {
+			return err
+		}
+		e.Attachments[i] = ref
+	}
+	return nil
+}
+
+// calendarResult итог обработки контент-плана
+type calendarResult struct {
+	published, scheduled, skipped int
+	failing                       int      // записи с ошибками, о которых уже сообщалось
+	overdue                       []string // записи, время которых прошло больше calendarGrace назад
+	errors                        []string // новые ошибки
+}
+
+// changed появились публикации, пропуски или новые ошибки, о которых нужно сообщить
+func (r calendarResult) changed() bool {
+	return r.published+r.scheduled+len(r.overdue)+len(r.errors) > 0
+}
+
+func (r calendarResult) String() string {
+	text := "Контент-план: опубликовано " + strconv.Itoa(r.published) + ", отложено " + strconv.Itoa(r.scheduled) +
+		", уже обработано " + strconv.Itoa(r.skipped)
+	if r.failing > 0 {
+		text += ", с прежними ошибками " + strconv.Itoa(r.failing)
+	}
+	if len(r.overdue) > 0 {
+		text += "\nНе опубликованы, время прошло больше " + calendarGrace.String() + " назад:\n" + strings.Join(r.overdue, "\n")
+	}
+	if len(r.errors) > 0 {
+		text += "\nОшибки:\n" + strings.Join(r.errors, "\n")
+	}
+	return text
+}
+
+// publishCalendar публикует новые записи плана: будущие как отложенные, опоздавшие не больше
+// чем на calendarGrace сразу; более старые отмечаются, чтобы не публиковать пропущенное разом
+func publishCalendar(ctx context.Context, path string, now time.Time) (calendarResult, error) {
+	var result calendarResult
+	entries, err := loadCalendar(path)
+	if err != nil {
+		return result, err
+	}
+
+	done := map[string]calendarRecord{}
+	err = updateJSON(calendarState, &done, func() (bool, error) {
+		publishEntries(ctx, entries, done, now, &result)
+		return true, nil
+	})
+	return result, err
+}
+
+// publishEntries публикует записи, которые еще не обработаны, и записывает их состояние в done;
+// об ошибке записи сообщается один раз, пока она не изменится
+func publishEntries(ctx context.Context, entries []calendarEntry, done map[string]calendarRecord, now time.Time, result *calendarResult) {
+	for _, e := range entries {
+		key := e.key()
+		if done[key].handled() {
+			result.skipped++
+			continue
+		}
+		fail := func(err error) {
+			if done[key].Error == err.Error() {
+				result.failing++
+				return
+			}
+			result.errors = append(result.errors, key+": "+err.Error())
+			done[key] = calendarRecord{Error: err.Error()}
+		}
+		if err := e.validate(); err != nil {
+			fail(err)
+			continue
+		}
+		if now.Sub(e.publishAt) > calendarGrace {
+			result.overdue = append(result.overdue, key+": "+e.PublishAt)
+			done[key] = calendarRecord{Overdue: true}
+			continue
+		}
+
+		if err := e.uploadAttachments(ctx); err != nil {
+			fail(err)
+			continue
+		}
+		postID, err := postToWall(ctx, e, now)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		done[key] = calendarRecord{PostID: postID}
+		if e.publishAt.After(now) {
+			result.scheduled++
+		} else {
+			result.published++
+		}
+	}
+}
+
+// postToWall публикует запись методом wall.post; запись с будущим временем становится отложенной
+func postToWall(ctx context.Context, e calendarEntry, now time.Time) (int, error) {
+	params := url.Values{}
+	params.Set("access_token", adminToken)
+	params.Set("owner_id", strconv.Itoa(vkOwnerID))
+	params.Set("from_group", "1")
+	params.Set("message", e.message())
+	if len(e.Attachments) > 0 {
+		params.Set("attachments", strings.Join(e.Attachments, ","))
+	}
+	if e.publishAt.After(now) {
+		params.Set("publish_date", strconv.FormatInt(e.publishAt.Unix(), 10))
+	}
+
+	var response struct {
+		PostID int `json:"post_id"`
+	}
+	err := callAPI(ctx, "wall.post", params, &response)
+	return response.PostID, err
+}
+
+// runCalendar задача по расписанию: обработать CALENDAR_FILE и сообщить администраторам об ошибках и публикациях
+func runCalendar(ctx context.Context, now time.Time) error {
+	if calendarFile == "" {
+		return nil
+	}
+	result, err := publishCalendar(ctx, calendarFile, now)
+	if err != nil {
+		return err
+	}
+	if result.changed() {
+		sendMessage(ctx, result.String(), sendToUserID)
+		sendMessage(ctx, result.String(), sendToUserIDControl)
+	}
+	return nil
+}
+
+// runCalendarCommand обрабатывает контент-план из командной строки
+func runCalendarCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("calendar", flag.ContinueOnError)
+	file := fs.String("file", calendarFile, "контент-план в формате YAML или CSV")
+	check := fs.Bool("dry-run", false, "только проверить план и показать, что будет опубликовано")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("укажите контент-план флагом -file или CALENDAR_FILE")
+	}
+	if *check {
+		dryRun = true
+		sink = printSink{w: os.Stdout}
+	}
+
+	result, err := publishCalendar(ctx, *file, time.Now())
+	if err != nil {
+		return err
+	}
+	sendMessage(ctx, result.String(), sendToUserID)
+	sendMessage(ctx, result.String(), sendToUserIDControl)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cliCommand команда, которую можно запустить локально: ./main <команда> [флаги]
+type cliCommand struct {
+	usage   string
+	run     func(ctx context.Context, args []string) error
+	offline bool // команда задает настройки сама и работает без TOKEN, GROUP_ID и VKAPI
+}
+
+var cliCommands = map[string]cliCommand{
+	"replay":   {"повторно обработать сохраненные события (EVENT_STORE)", runReplay, false},
+	"calendar": {"опубликовать записи контент-плана (CALENDAR_FILE)", runCalendarCommand, false},
+	"serve":    {"принимать события Callback API по HTTP, метрики на /metrics", runServe, false},
+	"setup":    {"зарегистрировать сервер Callback API и включить обрабатываемые события", runSetup, false},
+	// simulate и post добавляет simulate.go при сборке с тегом simulate
+}
+
+// runCommand выполняет команду из аргументов запуска и возвращает код выхода
+func runCommand(args []string) int {
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "неизвестная команда %q, доступны:\n", args[0])
+		var names []string
+		for name := range cliCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, cliCommands[name].usage)
+		}
+		return 2
+	}
+	if err := initConfig(); err != nil && !command.offline {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if err := initEventStore(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if err := command.run(context.Background(), args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// printSink печатает уведомления вместо отправки
+type printSink struct {
+	w io.Writer
+}
+
+func (p printSink) Send(ctx context.Context, message, userID string) error {
+	fmt.Fprintf(p.w, "→ %v: %v\n", userID, message)
+	return nil
+}
+
+func (p printSink) SendNotification(ctx context.Context, n notification, userID string) error {
+	p.Send(ctx, n.Text, userID)
+	if len(n.Attachments) > 0 {
+		fmt.Fprintf(p.w, "  вложения: %v\n", strings.Join(n.Attachments, ","))
+	}
+	if len(n.Forward) > 0 {
+		fmt.Fprintf(p.w, "  пересылка сообщений: %v\n", n.Forward)
+	}
+	return nil
+}
+
+func (p printSink) Forward(ctx context.Context, header string, peerID int, conversationMessageIDs []int, toPeer string) error {
+	fmt.Fprintf(p.w, "→ %v: %v\n  пересылка из диалога %v: %v\n", toPeer, header, peerID, conversationMessageIDs)
+	return nil
+}
+
+// runReplay прогоняет сохраненные события через обработчики.
+// По умолчанию уведомления печатаются, а изменяющие вызовы API и запись в хранилища не выполняются;
+// с флагом -send события обрабатываются заново по-настоящему, например после сбоя.
+func runReplay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := fs.String("from", "", "начало периода, RFC3339 или 2006-01-02")
+	to := fs.String("to", "", "конец периода, RFC3339 или 2006-01-02")
+	types := fs.String("type", "", "типы событий через запятую")
+	send := fs.Bool("send", false, "отправлять уведомления и выполнять действия")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if rawEvents == nil {
+		return fmt.Errorf("хранилище событий не настроено, укажите EVENT_STORE")
+	}
+
+	fromTime, err := parseTimeArg(*from)
+	if err != nil {
+		return err
+	}
+	toTime, err := parseTimeArg(*to)
+	if err != nil {
+		return err
+	}
+	onlyTypes := splitList(*types)
+
+	if !*send {
+		dryRun = true
+		sink = printSink{w: os.Stdout}
+	}
+
+	defer flushTraces()
+	replayed := 0
+	err = rawEvents.Each(func(e storedEvent) error {
+		if !fromTime.IsZero() && e.Received.Before(fromTime) {
+			return nil
+		}
+		if !toTime.IsZero() && !e.Received.Before(toTime) {
+			return nil
+		}
+		if len(onlyTypes) > 0 && !contains(onlyTypes, e.Type) {
+			return nil
+		}
+
+		var event vkEvents
+		if err := json.Unmarshal(e.Event, &event); err != nil {
+			return fmt.Errorf("событие %v от %v: %v", e.Type, e.Received.Format(time.RFC3339), err)
+		}
+		fmt.Printf("# %v %v\n", e.Received.Format(time.RFC3339), e.Type)
+		if event.GroupID == 0 {
+			// события, сохраненные до появления нескольких сообществ, относятся к основному
+			event.GroupID = communities[0].GroupID
+		}
+		if c, ok := communityByID(event.GroupID); ok {
+			// секретный ключ не сохраняется, событие проверено при получении
+			event.Secret = c.Secret
+		}
+		if err := enterCommunity(event); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return nil
+		}
+		if _, err := handleLambdaEvent(ctx, event); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		replayed++
+		return nil
+	})
+	fmt.Printf("обработано событий: %d\n", replayed)
+	return err
+}
+
+// parseTimeArg разбирает время в формате RFC3339 или дату
+func parseTimeArg(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if !strings.Contains(s, "T") {
+		return time.ParseInLocation("2006-01-02", s, time.Local)
+	}
+	return time.Time{}, fmt.Errorf("неверное время %q", s)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vkClient клиент VK API
+type vkClient struct {
+	baseURL string        // адрес методов API, например https://api.vk.com/method/
+	http    *http.Client  // HTTP-клиент для вызовов и загрузки файлов
+	retries int           // сколько раз повторять запрос при временной ошибке
+	backoff time.Duration // пауза перед первым повтором, дальше удваивается
+}
+
+// vkAPI клиент, через который выполняются все вызовы API
+var vkAPI = &vkClient{
+	baseURL: strings.TrimSuffix(envOr("VK_API_URL", "https://api.vk.com/method"), "/") + "/", // другой адрес, например тестового сервера vktest
+	http:    myClient,
+	retries: 3,
+	backoff: time.Second,
+}
+
+// vkError описывает ошибку, которую возвращает VK API
+type vkError struct {
+	Code    int    `json:"error_code"`
+	Message string `json:"error_msg"`
+}
+
+func (e *vkError) Error() string {
+	return "VK API error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+// temporary ошибки, после которых запрос имеет смысл повторить
+func (e *vkError) temporary() bool {
+	switch e.Code {
+	case 1, 6, 9, 10: // неизвестная ошибка, слишком много запросов, флуд-контроль, внутренняя ошибка
+		return true
+	}
+	return false
+}
+
+// callAPI вызывает метод VK API и декодирует поле response в target
+func callAPI(ctx context.Context, method string, params url.Values, target interface{}) error {
+	return vkAPI.Call(ctx, method, params, target)
+}
+
+// Call вызывает метод VK API и декодирует поле response в target
+func (c *vkClient) Call(ctx context.Context, method string, params url.Values, target interface{}) error {
+	if dryRun && !isReadMethod(method) {
+		shown := url.Values{}
+		for k, v := range params {
+			if k != "access_token" {
+				shown[k] = v
+			}
+		}
+		log.Printf("DRY RUN: %v %v", method, shown.Encode())
+		return nil
+	}
+	if params.Get("access_token") == "" {
+		params.Set("access_token", token)
+	}
+	params.Set("v", vkAPIversion)
+
+	start := time.Now()
+	defer func() {
+		observeSince(metricAPIDuration, start, "method", method)
+	}()
+
+	var response json.RawMessage
+	err := traced(ctx, "vk "+method, func(ctx context.Context) error {
+		retries := c.retries
+		if !retryable(method) {
+			// изменяющий вызов мог выполниться, даже если ответ не дошел: повтор опубликовал бы запись дважды
+			retries = 0
+		}
+		return c.retry(ctx, retries, func() error {
+			r, err := post(ctx, c.http, c.baseURL+method, formContentType, strings.NewReader(params.Encode()))
+			if err != nil {
+				return err
+			}
+			defer r.Body.Close()
+			if r.StatusCode >= 500 {
+				return &httpError{status: r.Status}
+			}
+
+			var result struct {
+				Response json.RawMessage `json:"response"`
+				Error    *vkError        `json:"error"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+				return err
+			}
+			if result.Error != nil {
+				return result.Error
+			}
+			response = result.Response
+			return nil
+		})
+	}, "vk.method", method)
+	stats.Inc(metricAPICalls, "method", method, "result", resultLabel(err))
+	if err != nil || target == nil {
+		return err
+	}
+	return json.Unmarshal(response, target)
+}
+
+// formContentType тип тела запроса с параметрами формы
+const formContentType = "application/x-www-form-urlencoded"
+
+// post отправляет body методом POST; запрос прерывается вместе с ctx
+func post(ctx context.Context, client *http.Client, address, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return client.Do(req)
+}
+
+// httpError ответ сервера с кодом 5xx
+type httpError struct {
+	status string
+}
+
+func (e *httpError) Error() string {
+	return "HTTP " + e.status
+}
+
+// retryable методы, которые безопасно повторить: чтение и messages.send, повторы которого
+// VK отбрасывает по random_id
+func retryable(method string) bool {
+	return isReadMethod(method) || method == "messages.send"
+}
+
+// retry повторяет fn до retries раз при временных ошибках: сетевых, 5xx и ошибках API из temporary.
+// Пауза между попытками прерывается вместе с ctx, например по истечении времени Lambda.
+func (c *vkClient) retry(ctx context.Context, retries int, fn func() error) error {
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || !isTemporary(err) {
+			return err
+		}
+		log.Printf("error: попытка %d: %v, повтор через %v", attempt+1, err, wait)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func isTemporary(err error) bool {
+	switch e := err.(type) {
+	case *vkError:
+		return e.temporary()
+	case *httpError:
+		return true
+	case net.Error:
+		return true
+	case *url.Error:
+		return true
+	}
+	return false
+}
+
+// isReadMethod проверяет, что метод API только читает данные (users.get, wall.getById и т.п.)
+func isReadMethod(method string) bool {
+	name := method[strings.Index(method, ".")+1:]
+	return strings.HasPrefix(name, "get")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/vktest"
+)
+
+func TestRetry(t *testing.T) {
+	srv := newUploadServer(t)
+	prevRetries, prevBackoff := vkAPI.retries, vkAPI.backoff
+	vkAPI.retries, vkAPI.backoff = 2, time.Millisecond
+	defer func() { vkAPI.retries, vkAPI.backoff = prevRetries, prevBackoff }()
+
+	tests := []struct {
+		method string
+		calls  int
+	}{
+		{"users.get", 3},
+		{"messages.send", 3},
+		{"wall.post", 1},
+		{"groups.ban", 1},
+		{"wall.deleteComment", 1},
+	}
+	for _, tt := range tests {
+		srv.Reset()
+		srv.Handle(tt.method, &vktest.Error{Code: 10, Message: "Internal server error"})
+		if err := callAPI(context.Background(), tt.method, url.Values{}, nil); err == nil {
+			t.Errorf("%v: ожидалась ошибка", tt.method)
+		}
+		if got := len(srv.Calls()); got != tt.calls {
+			t.Errorf("%v: вызовов %d, ожидалось %d", tt.method, got, tt.calls)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	srv := newUploadServer(t)
+	prevRetries, prevBackoff := vkAPI.retries, vkAPI.backoff
+	vkAPI.retries, vkAPI.backoff = 2, time.Hour
+	defer func() { vkAPI.retries, vkAPI.backoff = prevRetries, prevBackoff }()
+
+	srv.Handle("users.get", &vktest.Error{Code: 10, Message: "Internal server error"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := callAPI(ctx, "users.get", url.Values{}, nil); err == nil {
+		t.Error("ожидалась ошибка")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("повтор не прерван по ctx: %v", d)
+	}
+	if got := len(srv.Calls()); got != 1 {
+		t.Errorf("вызовов %d, ожидался 1", got)
+	}
+}
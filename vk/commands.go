@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminCommand команда, которую администратор отправляет сообществу в личные сообщения
+type adminCommand func(ctx context.Context, args []string) (string, error)
+
+// adminCommands доступные команды; ответ отправляется администратору, который прислал команду
+var adminCommands = map[string]adminCommand{
+	"/members": func(ctx context.Context, args []string) (string, error) {
+		return membersReport(ctx, time.Now(), argInt(args, 0, membersReportDays))
+	},
+	"/growth": func(ctx context.Context, args []string) (string, error) {
+		return growthReport(ctx, time.Now(), argInt(args, 0, membersReportDays))
+	},
+	"/churn": func(ctx context.Context, args []string) (string, error) {
+		return churnReport(ctx, time.Now(), argInt(args, 0, membersReportDays), argInt(args, 1, membersChurnDays))
+	},
+	"/returning": func(ctx context.Context, args []string) (string, error) {
+		return returningReport(ctx, time.Now(), argInt(args, 0, membersReportDays))
+	},
+	"/leftafter": func(ctx context.Context, args []string) (string, error) {
+		postID := argInt(args, 0, 0)
+		if postID == 0 {
+			return "", errors.New("использование: /leftafter <id записи> [часов]")
+		}
+		return leftAfterPostReport(ctx, postID, time.Duration(argInt(args, 1, 24))*time.Hour)
+	},
+	"/tgedit": func(ctx context.Context, args []string) (string, error) {
+		postID := argInt(args, 0, 0)
+		if postID == 0 {
+			return "", errors.New("использование: /tgedit <id записи>")
+		}
+		return "Запись в Telegram обновлена", editTelegramPost(ctx, postID)
+	},
+	"/tgdelete": func(ctx context.Context, args []string) (string, error) {
+		postID := argInt(args, 0, 0)
+		if postID == 0 {
+			return "", errors.New("использование: /tgdelete <id записи>")
+		}
+		return "Запись удалена из Telegram", deleteTelegramPost(ctx, postID)
+	},
+	"/sla": func(ctx context.Context, args []string) (string, error) {
+		return responseReport(ctx, time.Now(), argInt(args, 0, responseReportDays))
+	},
+	"/top": func(ctx context.Context, args []string) (string, error) {
+		days := argInt(args, 0, 7)
+		report, _, err := leaderboardReport(ctx, "Самые активные участники за "+strconv.Itoa(days)+" дн.", time.Now().AddDate(0, 0, -days), time.Now())
+		return report, err
+	},
+}
+
+// runAdminCommand выполняет команду, если ее прислал администратор
+func runAdminCommand(ctx context.Context, fromID int, text string) (string, bool) {
+	if !isAdmin(fromID) {
+		return "", false
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", false
+	}
+	command, ok := adminCommands[strings.ToLower(fields[0])]
+	if !ok {
+		return "", false
+	}
+
+	reply, err := command(ctx, fields[1:])
+	if err != nil {
+		return "Ошибка: " + err.Error(), true
+	}
+	return reply, true
+}
+
+// argInt возвращает числовой аргумент команды или значение по умолчанию
+func argInt(args []string, i, def int) int {
+	if i >= len(args) {
+		return def
+	}
+	v, err := strconv.Atoi(args[i])
+	if err != nil {
+		return def
+	}
+	return v
+}
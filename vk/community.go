@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// community настройки одного сообщества, которое обслуживает функция
+type community struct {
+	GroupID           int    `yaml:"group_id"`
+	Name              string `yaml:"name"`
+	Token             string `yaml:"token"`              // ключ доступа сообщества
+	AdminToken        string `yaml:"admin_token"`        // ключ администратора, по умолчанию token
+	ModerationToken   string `yaml:"moderation_token"`   // ключ для модерации, по умолчанию admin_token
+	Secret            string `yaml:"secret"`             // секретный ключ Callback API; если задан, события без него отклоняются
+	ConfirmationToken string `yaml:"confirmation_token"` // строка подтверждения адреса сервера
+	UserID            string `yaml:"user_id"`            // получатель уведомлений, по умолчанию USERID
+	UserIDControl     string `yaml:"user_id_control"`    // дополнительный получатель, по умолчанию USERID_CONTROL
+	ForwardPeerID     string `yaml:"forward_peer_id"`    // куда пересылать личные сообщения, по умолчанию получатели уведомлений
+	Template          string `yaml:"template"`           // шаблон уведомлений, например "[{{.Name}}] {{.Text}}"
+	CalendarFile      string `yaml:"calendar_file"`      // контент-план сообщества
+	TelegramChannel   string `yaml:"telegram_channel"`   // канал для кросспостинга
+	DataDir           string `yaml:"data_dir"`           // каталог данных, по умолчанию DATA_DIR/<group_id>
+
+	template *template.Template
+	primary  bool // сообщество задано основными настройками (GROUP_ID, TOKEN...), а не в COMMUNITIES
+}
+
+// communities все обслуживаемые сообщества; первое используется по умолчанию.
+// Пустой список — настройки не загружены (команды, которые работают без них)
+var communities []community
+
+// loadCommunities читает список сообществ из значения COMMUNITIES и файла COMMUNITIES_FILE
+func loadCommunities(value, file string) ([]community, error) {
+	var list []community
+	if value != "" {
+		// JSON является подмножеством YAML
+		if err := yaml.Unmarshal([]byte(value), &list); err != nil {
+			return nil, fmt.Errorf("COMMUNITIES: %v", err)
+		}
+	}
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("COMMUNITIES_FILE: %v", err)
+		}
+		var fromFile []community
+		if err := yaml.Unmarshal(b, &fromFile); err != nil {
+			return nil, fmt.Errorf("COMMUNITIES_FILE %v: %v", file, err)
+		}
+		list = append(list, fromFile...)
+	}
+	return list, nil
+}
+
+// validateCommunities проверяет список сообществ и заполняет значения по умолчанию
+func (c *Config) validateCommunities() error {
+	seen := map[int]bool{}
+	for i := range c.Communities {
+		cm := &c.Communities[i]
+		if cm.GroupID <= 0 {
+			return fmt.Errorf("неверная конфигурация: сообщество %q: group_id должен быть положительным числом", cm.Name)
+		}
+		if seen[cm.GroupID] {
+			return fmt.Errorf("неверная конфигурация: сообщество %v указано дважды", cm.GroupID)
+		}
+		seen[cm.GroupID] = true
+		if cm.Token == "" {
+			return fmt.Errorf("неверная конфигурация: сообщество %v: не задан token", cm.GroupID)
+		}
+
+		if cm.AdminToken == "" {
+			cm.AdminToken = cm.Token
+		}
+		if cm.ModerationToken == "" {
+			cm.ModerationToken = cm.AdminToken
+		}
+		if cm.UserID == "" {
+			cm.UserID, cm.UserIDControl = c.UserID, c.UserIDControl
+		}
+		if cm.ForwardPeerID == "" {
+			cm.ForwardPeerID = cm.UserID + "," + cm.UserIDControl
+		}
+		if cm.DataDir == "" {
+			cm.DataDir = filepath.Join(dataDir, strconv.Itoa(cm.GroupID))
+		}
+		if cm.Template != "" {
+			t, err := template.New(strconv.Itoa(cm.GroupID)).Parse(cm.Template)
+			if err != nil {
+				return fmt.Errorf("неверная конфигурация: сообщество %v: шаблон: %v", cm.GroupID, err)
+			}
+			cm.template = t
+		}
+	}
+	return nil
+}
+
+// communityByID находит сообщество по group_id события
+func communityByID(groupID int) (community, bool) {
+	for _, c := range communities {
+		if c.GroupID == groupID {
+			return c, true
+		}
+	}
+	return community{}, false
+}
+
+// enterCommunity проверяет, что событие пришло от обслуживаемого сообщества с верным
+// секретным ключом, и переключает настройки на это сообщество. События без group_id
+// отклоняются: иначе они обработались бы без проверки ключа с настройками предыдущего события.
+func enterCommunity(event vkEvents) error {
+	if event.GroupID == 0 {
+		return errors.New("в событии нет group_id")
+	}
+	c, ok := communityByID(event.GroupID)
+	if !ok {
+		return errors.New("событие от неизвестного сообщества " + strconv.Itoa(event.GroupID))
+	}
+	if c.Secret != "" && event.Secret != c.Secret {
+		return errors.New("неверный секретный ключ в событии сообщества " + strconv.Itoa(event.GroupID))
+	}
+	useCommunity(c)
+	return nil
+}
+
+// currentCommunity сообщество, для которого сейчас обрабатывается событие или задача
+var currentCommunity community
+
+// useCommunity переключает глобальные настройки и хранилища на сообщество.
+// Lambda не передает экземпляру следующее событие, пока не завершено текущее, а serve
+// обрабатывает события под serveMu, поэтому настройки не меняются посреди обработки.
+func useCommunity(c community) {
+	currentCommunity = c
+
+	token, adminToken, moderationToken = c.Token, c.AdminToken, c.ModerationToken
+	confirmationToken = c.ConfirmationToken
+	vkGroupID, vkGroupName, vkOwnerID = strconv.Itoa(c.GroupID), c.Name, -c.GroupID
+	sendToUserID, sendToUserIDControl = c.UserID, c.UserIDControl
+	forwardPeers = splitList(c.ForwardPeerID)
+	calendarFile, telegramChannel = c.CalendarFile, c.TelegramChannel
+
+	// у каждого сообщества свои участники, рейтинг, сводки и расписание
+	dataDir = c.DataDir
+	digestBuffer = newDigestStore(dataPath("digest.jsonl"))
+	quietBuffer = newQuietStore(dataPath("quiet.jsonl"))
+	activityEvents = newActivityStore(dataPath("activity.jsonl"))
+	memberEvents = newMemberStore(dataPath("members.jsonl"))
+	scheduleState = dataPath("schedule.json")
+	calendarState = dataPath("calendar.json")
+	telegramPosts = dataPath("telegram.json")
+	inboxState = dataPath("inbox.json")
+	sentMessages = dataPath("sent.json")
+	responseLog = newResponseStore(dataPath("responses.jsonl"))
+	typingState = dataPath("typing.json")
+}
+
+// applyTemplate оформляет текст уведомления по шаблону текущего сообщества
+func applyTemplate(text string) string {
+	if currentCommunity.template == nil {
+		return text
+	}
+	var b bytes.Buffer
+	err := currentCommunity.template.Execute(&b, struct {
+		GroupID int
+		Name    string
+		Text    string
+	}{currentCommunity.GroupID, currentCommunity.Name, text})
+	if err != nil {
+		log.Printf("error: шаблон уведомлений сообщества %v: %v", currentCommunity.GroupID, err)
+		return text
+	}
+	return b.String()
+}
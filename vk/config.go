@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"gopkg.in/yaml.v2"
+)
+
+// minAPIVersion минимальная версия VK API, с которой работают обработчики событий
+const minAPIVersion = "5.103"
+
+// Config основные настройки бота. Загружаются при запуске в main или runCommand; значения из следующих
+// источников перекрывают предыдущие:
+//
+//	переменные окружения
+//	CONFIG_FILE         файл YAML или JSON с теми же ключами, что и переменные окружения
+//	CONFIG_SSM_PATH     параметры AWS SSM Parameter Store по пути, имя параметра — ключ
+//	CONFIG_SECRET_ID    секрет AWS Secrets Manager в виде JSON-объекта с теми же ключами
+//
+// Для совместимых хранилищ адрес задается CONFIG_AWS_ENDPOINT, время на загрузку — CONFIG_TIMEOUT.
+//
+// Несколько сообществ описываются списком в COMMUNITIES (YAML или JSON, можно хранить
+// в секрете) или в файле COMMUNITIES_FILE; сообщество из GROUP_ID, если задано, добавляется первым.
+type Config struct {
+	ConfirmationToken string // CONFIRMATION_TOKEN строка подтверждения Callback API
+	Token             string // TOKEN ключ доступа сообщества
+	AdminToken        string // ADMIN_TOKEN ключ администратора, по умолчанию TOKEN
+	APIVersion        string // VKAPI версия API
+	UserID            string // USERID пользователь, которому отправляются уведомления
+	UserIDControl     string // USERID_CONTROL дополнительный получатель уведомлений
+	GroupID           string // GROUP_ID идентификатор сообщества
+	GroupName         string // GROUP_NAME название сообщества
+	Secret            string // SECRET секретный ключ Callback API
+
+	Communities []community // все обслуживаемые сообщества
+
+	ownerID int // идентификатор сообщества как владельца объектов (отрицательный)
+}
+
+// configKeys ключи настроек, которые читаются из всех источников
+var configKeys = []string{"CONFIRMATION_TOKEN", "TOKEN", "ADMIN_TOKEN", "VKAPI", "USERID", "USERID_CONTROL", "GROUP_ID", "GROUP_NAME", "SECRET", "COMMUNITIES"}
+
+// configProvider источник настроек; возвращает значения по ключам configKeys
+type configProvider interface {
+	Values(ctx context.Context) (map[string]string, error)
+}
+
+// configSaver источник, в который можно записать значение настройки
+type configSaver interface {
+	Save(ctx context.Context, key, value string) error
+}
+
+// configTimeout ограничивает загрузку настроек, чтобы недоступное хранилище не занимало весь холодный старт
+var configTimeout = envDuration("CONFIG_TIMEOUT", 10*time.Second)
+
+// initConfig загружает настройки с ограничением configTimeout и переключается на первое сообщество
+func initConfig() error {
+	ctx, cancel := context.WithTimeout(context.Background(), configTimeout)
+	defer cancel()
+	c, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	vkAPIversion = c.APIVersion
+	communities = c.Communities
+	useCommunity(communities[0])
+	return nil
+}
+
+// loadConfig собирает настройки из всех источников и проверяет их
+func loadConfig(ctx context.Context) (Config, error) {
+	values := map[string]string{}
+	for _, p := range configProviders() {
+		v, err := p.Values(ctx)
+		if err != nil {
+			return Config{}, err
+		}
+		for _, key := range configKeys {
+			if s, ok := v[key]; ok && s != "" {
+				values[key] = s
+			}
+		}
+	}
+
+	c := Config{
+		ConfirmationToken: values["CONFIRMATION_TOKEN"],
+		Token:             values["TOKEN"],
+		AdminToken:        values["ADMIN_TOKEN"],
+		APIVersion:        values["VKAPI"],
+		UserID:            values["USERID"],
+		UserIDControl:     values["USERID_CONTROL"],
+		GroupID:           values["GROUP_ID"],
+		GroupName:         values["GROUP_NAME"],
+		Secret:            values["SECRET"],
+	}
+	if c.AdminToken == "" {
+		c.AdminToken = c.Token
+	}
+
+	list, err := loadCommunities(values["COMMUNITIES"], os.Getenv("COMMUNITIES_FILE"))
+	if err != nil {
+		return c, err
+	}
+	if c.GroupID == "" && len(list) > 0 {
+		// без GROUP_ID сообщества берутся из списка как есть, первое используется по умолчанию;
+		// основные настройки заполняются из него только для проверки и значений по умолчанию
+		first := list[0]
+		c.GroupID, c.GroupName, c.Secret = strconv.Itoa(first.GroupID), first.Name, first.Secret
+		c.Token, c.AdminToken, c.ConfirmationToken = first.Token, first.AdminToken, first.ConfirmationToken
+		if first.UserID != "" {
+			c.UserID, c.UserIDControl = first.UserID, first.UserIDControl
+		}
+		if c.AdminToken == "" {
+			c.AdminToken = c.Token
+		}
+		if err := c.validate(); err != nil {
+			return c, err
+		}
+		c.Communities = list
+		return c, c.validateCommunities()
+	}
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+
+	// сообщество из основных настроек хранит данные прямо в DATA_DIR, как до появления списка
+	c.Communities = append([]community{{
+		primary:           true,
+		GroupID:           -c.ownerID,
+		Name:              c.GroupName,
+		Token:             c.Token,
+		AdminToken:        c.AdminToken,
+		Secret:            c.Secret,
+		ConfirmationToken: c.ConfirmationToken,
+		UserID:            c.UserID,
+		UserIDControl:     c.UserIDControl,
+		ForwardPeerID:     os.Getenv("FORWARD_PEER_ID"),
+		ModerationToken:   os.Getenv("MODERATION_TOKEN"),
+		Template:          os.Getenv("NOTIFY_TEMPLATE"),
+		CalendarFile:      os.Getenv("CALENDAR_FILE"),
+		TelegramChannel:   os.Getenv("TELEGRAM_CHANNEL"),
+		DataDir:           dataDir,
+	}}, list...)
+	return c, c.validateCommunities()
+}
+
+// configProviders источники настроек в порядке возрастания приоритета
+func configProviders() []configProvider {
+	providers := []configProvider{envProvider{}}
+	if file := os.Getenv("CONFIG_FILE"); file != "" {
+		providers = append(providers, fileProvider{path: file})
+	}
+	if p := os.Getenv("CONFIG_SSM_PATH"); p != "" {
+		providers = append(providers, ssmProvider{path: p})
+	}
+	if id := os.Getenv("CONFIG_SECRET_ID"); id != "" {
+		providers = append(providers, secretProvider{id: id})
+	}
+	return providers
+}
+
+// saveConfigValue записывает значение в источник с наибольшим приоритетом, который это умеет,
+// и возвращает его название; пустое название — записать некуда
+func saveConfigValue(ctx context.Context, key, value string) (string, error) {
+	providers := configProviders()
+	for i := len(providers) - 1; i >= 0; i-- {
+		if saver, ok := providers[i].(configSaver); ok {
+			return fmt.Sprint(providers[i]), saver.Save(ctx, key, value)
+		}
+	}
+	return "", nil
+}
+
+// validate проверяет обязательные настройки и вычисляет производные значения
+func (c *Config) validate() error {
+	var problems []string
+	if c.Token == "" {
+		problems = append(problems, "не задан TOKEN")
+	}
+
+	if c.GroupID == "" {
+		problems = append(problems, "не задан GROUP_ID")
+	} else if id, err := strconv.Atoi(c.GroupID); err != nil || id <= 0 {
+		problems = append(problems, fmt.Sprintf("GROUP_ID %q должен быть положительным числом без минуса", c.GroupID))
+	} else {
+		c.ownerID = -id
+	}
+
+	if c.APIVersion == "" {
+		problems = append(problems, "не задана версия API VKAPI (не ниже "+minAPIVersion+")")
+	} else if !versionAtLeast(c.APIVersion, minAPIVersion) {
+		problems = append(problems, fmt.Sprintf("версия API VKAPI %q ниже %v", c.APIVersion, minAPIVersion))
+	}
+
+	for i, v := range []string{c.UserID, c.UserIDControl} {
+		if _, err := strconv.Atoi(v); v != "" && err != nil {
+			problems = append(problems, fmt.Sprintf("%v %q должен быть числом", []string{"USERID", "USERID_CONTROL"}[i], v))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("неверная конфигурация: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// versionAtLeast сравнивает версии вида 5.103 по числам, а не как строки
+func versionAtLeast(version, min string) bool {
+	v, m := strings.Split(version, "."), strings.Split(min, ".")
+	for i := range m {
+		if i >= len(v) {
+			return false
+		}
+		a, err := strconv.Atoi(v[i])
+		if err != nil {
+			return false
+		}
+		b, _ := strconv.Atoi(m[i])
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+// envProvider читает настройки из переменных окружения
+type envProvider struct{}
+
+func (envProvider) Values(ctx context.Context) (map[string]string, error) {
+	values := map[string]string{}
+	for _, key := range configKeys {
+		values[key] = os.Getenv(key)
+	}
+	return values, nil
+}
+
+// fileProvider читает настройки из файла YAML или JSON
+type fileProvider struct {
+	path string
+}
+
+func (p fileProvider) Values(ctx context.Context) (map[string]string, error) {
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %v", err)
+	}
+	// JSON является подмножеством YAML, поэтому хватает одного разбора
+	values := map[string]string{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE %v: %v", p.path, err)
+	}
+	return values, nil
+}
+
+// ssmProvider читает параметры SSM Parameter Store по пути, например /vk-bot/prod
+type ssmProvider struct {
+	path string
+}
+
+func (p ssmProvider) Values(ctx context.Context) (map[string]string, error) {
+	sess, err := configSession()
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	err = ssm.New(sess).GetParametersByPathPagesWithContext(ctx, &ssm.GetParametersByPathInput{
+		Path:           aws.String(p.path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	}, func(page *ssm.GetParametersByPathOutput, last bool) bool {
+		for _, param := range page.Parameters {
+			values[path.Base(aws.StringValue(param.Name))] = aws.StringValue(param.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_SSM_PATH %v: %v", p.path, err)
+	}
+	return values, nil
+}
+
+// Save записывает параметр path/key, зашифрованный так же, как остальные
+func (p ssmProvider) Save(ctx context.Context, key, value string) error {
+	sess, err := configSession()
+	if err != nil {
+		return err
+	}
+	_, err = ssm.New(sess).PutParameterWithContext(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(strings.TrimSuffix(p.path, "/") + "/" + key),
+		Value:     aws.String(value),
+		Type:      aws.String(ssm.ParameterTypeSecureString),
+		Overwrite: aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("CONFIG_SSM_PATH %v: %v", p.path, err)
+	}
+	return nil
+}
+
+func (p ssmProvider) String() string {
+	return "SSM " + p.path
+}
+
+// secretProvider читает секрет Secrets Manager с JSON-объектом настроек
+type secretProvider struct {
+	id string
+}
+
+func (p secretProvider) Values(ctx context.Context) (map[string]string, error) {
+	sess, err := configSession()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := secretsmanager.New(sess).GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(p.id)})
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_SECRET_ID %v: %v", p.id, err)
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal([]byte(aws.StringValue(out.SecretString)), &values); err != nil {
+		return nil, fmt.Errorf("CONFIG_SECRET_ID %v: секрет должен быть JSON-объектом со строковыми значениями: %v", p.id, err)
+	}
+	return values, nil
+}
+
+// Save записывает ключ в JSON-объект секрета новой версией, остальные ключи не меняются
+func (p secretProvider) Save(ctx context.Context, key, value string) error {
+	values, err := p.Values(ctx)
+	if err != nil {
+		return err
+	}
+	values[key] = value
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	sess, err := configSession()
+	if err != nil {
+		return err
+	}
+	_, err = secretsmanager.New(sess).PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(p.id),
+		SecretString: aws.String(string(b)),
+	})
+	if err != nil {
+		return fmt.Errorf("CONFIG_SECRET_ID %v: %v", p.id, err)
+	}
+	return nil
+}
+
+func (p secretProvider) String() string {
+	return "Secrets Manager " + p.id
+}
+
+// configSession сессия AWS для хранилищ настроек
+func configSession() (*session.Session, error) {
+	cfg := aws.NewConfig().WithRegion(envOr("AWS_REGION", "us-east-1"))
+	if endpoint := os.Getenv("CONFIG_AWS_ENDPOINT"); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	return session.NewSession(cfg)
+}
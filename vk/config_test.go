@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version, min string
+		ok           bool
+	}{
+		{"5.103", "5.103", true},
+		{"5.131", "5.103", true},
+		{"5.99", "5.103", false}, // как строки "5.99" > "5.103"
+		{"6.0", "5.103", true},
+		{"4.200", "5.103", false},
+		{"5", "5.103", false},
+		{"5.103.1", "5.103", true},
+		{"5.x", "5.103", false},
+		{"", "5.103", false},
+	}
+	for _, tt := range tests {
+		if got := versionAtLeast(tt.version, tt.min); got != tt.ok {
+			t.Errorf("versionAtLeast(%q, %q) = %v, ожидалось %v", tt.version, tt.min, got, tt.ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{Token: "t", GroupID: "5", APIVersion: "5.131", UserID: "100", UserIDControl: "200"}
+	tests := []struct {
+		name     string
+		change   func(c *Config)
+		problems []string // фрагменты сообщения об ошибке; пусто — настройки верны
+	}{
+		{"верные настройки", func(c *Config) {}, nil},
+		{"без получателей", func(c *Config) { c.UserID, c.UserIDControl = "", "" }, nil},
+		{"нет TOKEN", func(c *Config) { c.Token = "" }, []string{"не задан TOKEN"}},
+		{"нет GROUP_ID", func(c *Config) { c.GroupID = "" }, []string{"не задан GROUP_ID"}},
+		{"GROUP_ID с минусом", func(c *Config) { c.GroupID = "-5" }, []string{`GROUP_ID "-5"`}},
+		{"GROUP_ID не число", func(c *Config) { c.GroupID = "club5" }, []string{`GROUP_ID "club5"`}},
+		{"нет VKAPI", func(c *Config) { c.APIVersion = "" }, []string{"не задана версия API"}},
+		{"старый VKAPI", func(c *Config) { c.APIVersion = "5.99" }, []string{`VKAPI "5.99" ниже 5.103`}},
+		{"USERID не число", func(c *Config) { c.UserIDControl = "id200" }, []string{`USERID_CONTROL "id200"`}},
+		{"все проблемы сразу", func(c *Config) { *c = Config{UserID: "x"} }, []string{"TOKEN", "GROUP_ID", "VKAPI", `USERID "x"`}},
+	}
+	for _, tt := range tests {
+		c := valid
+		tt.change(&c)
+		err := c.validate()
+		if len(tt.problems) == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			} else if c.ownerID != -5 {
+				t.Errorf("%v: ownerID = %d, ожидалось -5", tt.name, c.ownerID)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%v: ожидалась ошибка", tt.name)
+			continue
+		}
+		for _, p := range tt.problems {
+			if !strings.Contains(err.Error(), p) {
+				t.Errorf("%v: в ошибке %q нет %q", tt.name, err, p)
+			}
+		}
+	}
+}
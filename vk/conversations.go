@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Аналитика личных сообщений: ответы из responseLog и сообщения, ожидающие ответа, складываются
+// в диалоги, по ним считается время первого ответа и решения, нагрузка по дням и часам
+var (
+	conversationIdle = envDuration("CONVERSATION_IDLE", 24*time.Hour)  // Перерыв, после которого диалог считается завершенным
+	responseLocation = mustLocation(envOr("RESPONSE_TIMEZONE", "UTC")) // Часовой пояс для дней и часов в отчете о времени ответа
+)
+
+// mustLocation возвращает часовой пояс из настройки или UTC, если настройка неверна
+func mustLocation(name string) *time.Location {
+	location, err := parseLocation(name)
+	if err != nil {
+		log.Printf("error: часовой пояс %q: %v", name, err)
+		return time.UTC
+	}
+	return location
+}
+
+// conversation диалог: сообщения пользователя и ответы сообщества без перерыва дольше conversationIdle
+type conversation struct {
+	PeerID     int
+	Start      time.Time // первое сообщение пользователя
+	FirstReply time.Time // первый ответ сообщества, нулевое время — ответа нет
+	LastReply  time.Time
+	Pending    bool // последние сообщения пользователя еще без ответа
+}
+
+// last время последнего ответа или, если ответа нет, начала диалога
+func (c *conversation) last() time.Time {
+	if c.LastReply.IsZero() {
+		return c.Start
+	}
+	return c.LastReply
+}
+
+// resolved диалог завершен: все сообщения отвечены и с последнего ответа прошло conversationIdle
+func (c *conversation) resolved(now time.Time) bool {
+	return !c.Pending && !c.LastReply.IsZero() && now.Sub(c.LastReply) >= conversationIdle
+}
+
+// received время сообщений пользователя, на которые дан ответ r
+func (r responseRecord) received() []time.Time {
+	if len(r.Received) > 0 {
+		return r.Received
+	}
+	// записи без времени сообщений: известно только первое
+	return []time.Time{r.Time.Add(-time.Duration(r.Seconds * float64(time.Second)))}
+}
+
+// pairConversations складывает ответы и сообщения, ожидающие ответа, в диалоги. Ответ относится
+// к диалогу, если сообщения, на которые он дан, пришли не позже conversationIdle после предыдущего ответа.
+func pairConversations(responses []responseRecord, inbox map[string]pendingMessage) []*conversation {
+	type wait struct {
+		peerID   int
+		received []time.Time
+		reply    *responseRecord // nil — ответа еще нет
+	}
+	var waits []wait
+	for i := range responses {
+		r := &responses[i]
+		waits = append(waits, wait{peerID: r.PeerID, received: r.received(), reply: r})
+	}
+	for _, p := range inbox {
+		received := p.Received
+		if len(received) == 0 {
+			received = []time.Time{p.Time}
+		}
+		waits = append(waits, wait{peerID: p.PeerID, received: received})
+	}
+	sort.SliceStable(waits, func(i, j int) bool {
+		return waits[i].received[0].Before(waits[j].received[0])
+	})
+
+	var list []*conversation
+	open := map[int]*conversation{}
+	for _, w := range waits {
+		c := open[w.peerID]
+		if c == nil || w.received[0].Sub(c.last()) > conversationIdle {
+			c = &conversation{PeerID: w.peerID, Start: w.received[0]}
+			list = append(list, c)
+			open[w.peerID] = c
+		}
+		if w.reply == nil {
+			c.Pending = true
+			continue
+		}
+		if c.FirstReply.IsZero() {
+			c.FirstReply = w.reply.Time
+		}
+		c.LastReply = w.reply.Time
+	}
+	return list
+}
+
+// conversationLines считает с from по now число диалогов и сообщений, время первого ответа
+// и решения, сообщения по дням и самые загруженные часы
+func conversationLines(now, from time.Time, days int, responses []responseRecord, inbox map[string]pendingMessage) []string {
+	perDay, perHour := map[string]int{}, map[int]int{}
+	incoming := 0
+	count := func(t time.Time) {
+		if t.Before(from) {
+			return
+		}
+		local := t.In(responseLocation)
+		perDay[local.Format("2006-01-02")]++
+		perHour[local.Hour()]++
+		incoming++
+	}
+	for _, r := range responses {
+		for _, t := range r.received() {
+			count(t)
+		}
+	}
+	for _, p := range inbox {
+		for _, t := range p.Received {
+			count(t)
+		}
+	}
+
+	var firstReplies, resolutions []time.Duration
+	unanswered, total := 0, 0
+	for _, c := range pairConversations(responses, inbox) {
+		if c.Start.Before(from) {
+			continue
+		}
+		total++
+		if c.FirstReply.IsZero() {
+			unanswered++
+			continue
+		}
+		firstReplies = append(firstReplies, c.FirstReply.Sub(c.Start))
+		if c.resolved(now) {
+			resolutions = append(resolutions, c.LastReply.Sub(c.Start))
+		}
+	}
+
+	lines := []string{
+		fmt.Sprintf("Диалогов: %d, сообщений от пользователей: %d (в среднем %.1f в день)", total, incoming, float64(incoming)/float64(days)),
+	}
+	if len(firstReplies) > 0 {
+		lines = append(lines, "Первый ответ: медиана "+formatWait(percentile(firstReplies, 50))+", 90% — до "+formatWait(percentile(firstReplies, 90)))
+	}
+	if unanswered > 0 {
+		lines = append(lines, "Диалогов без ответа: "+strconv.Itoa(unanswered))
+	}
+	if len(resolutions) > 0 {
+		lines = append(lines, "Решение: медиана "+formatWait(percentile(resolutions, 50))+", завершено диалогов: "+strconv.Itoa(len(resolutions)))
+	}
+
+	lines = append(lines, "По дням:")
+	for d := from; !d.After(now); d = d.AddDate(0, 0, 1) {
+		day := d.Format("2006-01-02")
+		lines = append(lines, day+": "+strconv.Itoa(perDay[day]))
+	}
+	if hours := busiestHours(perHour, 3); len(hours) > 0 {
+		lines = append(lines, "Часы пик: "+strings.Join(hours, ", "))
+	}
+	return lines
+}
+
+// busiestHours возвращает n часов с наибольшим числом сообщений вида "14:00 — 9"
+func busiestHours(perHour map[int]int, n int) []string {
+	var hours []int
+	for h := range perHour {
+		hours = append(hours, h)
+	}
+	sort.Slice(hours, func(i, j int) bool {
+		if perHour[hours[i]] != perHour[hours[j]] {
+			return perHour[hours[i]] > perHour[hours[j]]
+		}
+		return hours[i] < hours[j]
+	})
+	if len(hours) > n {
+		hours = hours[:n]
+	}
+	var list []string
+	for _, h := range hours {
+		list = append(list, fmt.Sprintf("%02d:00 — %d", h, perHour[h]))
+	}
+	return list
+}
+
+// percentile возвращает p-й процентиль длительностей
+func percentile(list []time.Duration, p int) time.Duration {
+	sorted := append([]time.Duration(nil), list...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	list := []time.Duration{5 * time.Minute, time.Minute, 3 * time.Minute, 2 * time.Minute, 4 * time.Minute}
+	tests := []struct {
+		list []time.Duration
+		p    int
+		want time.Duration
+	}{
+		{list, 50, 3 * time.Minute},
+		{list, 90, 5 * time.Minute},
+		{list, 100, 5 * time.Minute},
+		{list, 20, time.Minute},
+		{list, 0, time.Minute},
+		{[]time.Duration{time.Hour}, 50, time.Hour},
+		{[]time.Duration{time.Minute, time.Hour}, 50, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.list, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %d) = %v, ожидалось %v", tt.list, tt.p, got, tt.want)
+		}
+	}
+	if list[0] != 5*time.Minute {
+		t.Error("percentile изменил порядок исходного списка")
+	}
+}
+
+func TestPairConversations(t *testing.T) {
+	prev := conversationIdle
+	defer func() { conversationIdle = prev }()
+	conversationIdle = 24 * time.Hour
+
+	start := time.Date(2026, 1, 10, 9, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	reply := func(peer int, replied time.Duration, received ...time.Duration) responseRecord {
+		r := responseRecord{PeerID: peer, Time: at(replied)}
+		for _, d := range received {
+			r.Received = append(r.Received, at(d))
+		}
+		return r
+	}
+
+	type want struct {
+		peer       int
+		start      time.Duration
+		firstReply time.Duration // -1 — ответа нет
+		pending    bool
+	}
+	tests := []struct {
+		name      string
+		responses []responseRecord
+		inbox     map[string]pendingMessage
+		want      []want
+	}{
+		{
+			name:      "два ответа в одном диалоге",
+			responses: []responseRecord{reply(555, 10*time.Minute, 0), reply(555, 2*time.Hour, time.Hour)},
+			want:      []want{{555, 0, 10 * time.Minute, false}},
+		},
+		{
+			name:      "перерыв дольше conversationIdle начинает новый диалог",
+			responses: []responseRecord{reply(555, 10*time.Minute, 0), reply(555, 50*time.Hour, 48*time.Hour)},
+			want:      []want{{555, 0, 10 * time.Minute, false}, {555, 48 * time.Hour, 50 * time.Hour, false}},
+		},
+		{
+			name:      "сообщение без ответа продолжает диалог",
+			responses: []responseRecord{reply(555, 10*time.Minute, 0)},
+			inbox:     map[string]pendingMessage{"555": {PeerID: 555, Received: []time.Time{at(time.Hour)}}},
+			want:      []want{{555, 0, 10 * time.Minute, true}},
+		},
+		{
+			name:  "только сообщение без ответа",
+			inbox: map[string]pendingMessage{"777": {PeerID: 777, Time: at(time.Hour)}},
+			want:  []want{{777, time.Hour, -1, true}},
+		},
+		{
+			name: "диалоги разных пользователей",
+			responses: []responseRecord{
+				reply(555, 10*time.Minute, 0),
+				reply(777, 40*time.Minute, 5*time.Minute),
+			},
+			want: []want{{555, 0, 10 * time.Minute, false}, {777, 5 * time.Minute, 40 * time.Minute, false}},
+		},
+		{
+			// старые записи без времени сообщений: начало диалога по времени ожидания
+			name:      "запись без времени сообщений",
+			responses: []responseRecord{{PeerID: 555, Time: at(time.Hour), Seconds: 1800}},
+			want:      []want{{555, 30 * time.Minute, time.Hour, false}},
+		},
+	}
+	for _, tt := range tests {
+		got := pairConversations(tt.responses, tt.inbox)
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: диалогов %d, ожидалось %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, w := range tt.want {
+			c := got[i]
+			firstReply := time.Duration(-1)
+			if !c.FirstReply.IsZero() {
+				firstReply = c.FirstReply.Sub(start)
+			}
+			if c.PeerID != w.peer || c.Start.Sub(start) != w.start || firstReply != w.firstReply || c.Pending != w.pending {
+				t.Errorf("%v: диалог %d: %+v, ожидалось %+v", tt.name, i, c, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Сводки вместо отдельного сообщения на каждое событие
+var (
+	digestEvents = splitList(os.Getenv("DIGEST_EVENTS"))        // Типы событий, которые собираются в сводку
+	digestWindow = envDuration("DIGEST_WINDOW", 15*time.Minute) // Интервал, за который собирается сводка
+	digestBuffer = newDigestStore(dataPath("digest.jsonl"))     // Хранилище событий до отправки сводки
+	digestNames  = envInt("DIGEST_NAMES", 10)                   // Сколько участников перечислять в сводке
+	digestLimit  = envInt("DIGEST_LENGTH", 4000)                // Длина одного сообщения сводки
+)
+
+// digestItem событие, отложенное до отправки сводки
+type digestItem struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	ObjectType string    `json:"object_type"`
+	ObjectID   int       `json:"object_id"`
+	UserID     int       `json:"user_id"`
+}
+
+// digestStore хранит отложенные события между вызовами функции
+type digestStore interface {
+	Add(item digestItem) error
+	// Drain возвращает все накопленные события и очищает хранилище
+	Drain() ([]digestItem, error)
+	// Oldest возвращает время самого раннего события
+	Oldest() (time.Time, bool, error)
+}
+
+// fileDigestStore хранит события в файле JSON lines
+type fileDigestStore struct {
+	file *jsonlFile
+}
+
+func newDigestStore(path string) digestStore {
+	return fileDigestStore{file: &jsonlFile{path: path}}
+}
+
+func (s fileDigestStore) Add(item digestItem) error {
+	return s.file.Append(item)
+}
+
+func (s fileDigestStore) Drain() ([]digestItem, error) {
+	var items []digestItem
+	err := s.file.Drain(func(line []byte) error {
+		var item digestItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func (s fileDigestStore) Oldest() (time.Time, bool, error) {
+	var oldest time.Time
+	found := false
+	err := s.file.ReadAll(func(line []byte) error {
+		var item digestItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+		if !found || item.Time.Before(oldest) {
+			oldest, found = item.Time, true
+		}
+		return nil
+	})
+	return oldest, found, err
+}
+
+// newDigestItem определяет объект и участника события; false, если событие не попадает в сводки
+func newDigestItem(event vkEvents) (digestItem, bool) {
+	item := digestItem{Time: time.Now().UTC(), Type: event.Type, UserID: event.Object.FromID}
+	switch event.Type {
+	case "like_add", "like_remove":
+		item.ObjectType, item.ObjectID, item.UserID = event.Object.ObjectType, event.Object.ObjectID, event.Object.LikerID
+	case "wall_reply_new":
+		item.ObjectType, item.ObjectID = "post", event.Object.PostID
+	case "wall_repost":
+		item.ObjectType, item.ObjectID = "post", event.repost().ID
+	case "photo_comment_new":
+		item.ObjectType, item.ObjectID = "photo", event.Object.PhotoID
+	case "board_post_new":
+		item.ObjectType, item.ObjectID = "topic", event.Object.TopicID
+	case "market_comment_new":
+		item.ObjectType, item.ObjectID = "market", event.Object.ItemID
+	default:
+		return item, false
+	}
+	return item, true
+}
+
+// bufferForDigest откладывает событие до сводки, если для его типа включен режим сводок
+func bufferForDigest(event vkEvents) bool {
+	if !contains(digestEvents, event.Type) {
+		return false
+	}
+	item, ok := newDigestItem(event)
+	if !ok {
+		return false
+	}
+	if err := digestBuffer.Add(item); err != nil {
+		// не теряем событие: пусть уйдет обычным уведомлением
+		log.Printf("error: не удалось отложить событие в сводку: %v", err)
+		return false
+	}
+	return true
+}
+
+// flushDigest отправляет сводку, если с момента первого накопленного события прошло digestWindow
+func flushDigest(ctx context.Context, now time.Time) error {
+	oldest, found, err := digestBuffer.Oldest()
+	if err != nil || !found || now.Sub(oldest) < digestWindow {
+		return err
+	}
+
+	items, err := digestBuffer.Drain()
+	if err != nil {
+		return err
+	}
+	// одно сообщение на получателя; на несколько сводка делится только по длине
+	header := "Сводка за " + formatWait(now.Sub(oldest)) + " (событий: " + strconv.Itoa(len(items)) + "):"
+	for _, message := range joinLimited(header, renderDigest(ctx, items), digestLimit) {
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
+	}
+	return nil
+}
+
+// digestObject счетчики по одному объекту
+type digestObject struct {
+	objectType string
+	objectID   int
+	counts     map[string]int
+	users      []int
+}
+
+// renderDigest группирует события по объектам и формирует по строке на объект
+func renderDigest(ctx context.Context, items []digestItem) []string {
+	objects := map[string]*digestObject{}
+	var order []string
+	for _, item := range items {
+		key := item.ObjectType + strconv.Itoa(item.ObjectID)
+		o, ok := objects[key]
+		if !ok {
+			o = &digestObject{objectType: item.ObjectType, objectID: item.ObjectID, counts: map[string]int{}}
+			objects[key] = o
+			order = append(order, key)
+		}
+		o.counts[item.Type]++
+		if !containsInt(o.users, item.UserID) {
+			o.users = append(o.users, item.UserID)
+		}
+	}
+
+	// самые активные объекты первыми
+	sort.SliceStable(order, func(i, j int) bool {
+		return total(objects[order[i]].counts) > total(objects[order[j]].counts)
+	})
+
+	var messages []string
+	for _, key := range order {
+		o := objects[key]
+		var parts []string
+		if n := o.counts["like_add"]; n > 0 {
+			parts = append(parts, "+"+strconv.Itoa(n)+" лайков")
+		}
+		if n := o.counts["like_remove"]; n > 0 {
+			parts = append(parts, "−"+strconv.Itoa(n)+" лайков")
+		}
+		if n := o.counts["wall_reply_new"] + o.counts["photo_comment_new"] + o.counts["board_post_new"] + o.counts["market_comment_new"]; n > 0 {
+			parts = append(parts, strconv.Itoa(n)+" комментариев")
+		}
+		if n := o.counts["wall_repost"]; n > 0 {
+			parts = append(parts, strconv.Itoa(n)+" репостов")
+		}
+		messages = append(messages, digestObjectName(o.objectType, o.objectID)+excerpt(ctx, o.objectType, vkOwnerID, o.objectID)+": "+strings.Join(parts, ", ")+", от: "+userNames(ctx, o.users, digestNames))
+	}
+	return messages
+}
+
+// digestObjectName возвращает название объекта со ссылкой
+func digestObjectName(objectType string, objectID int) string {
+	switch objectType {
+	case "post":
+		return "Запись " + links.WallPost(vkOwnerID, objectID)
+	case "photo":
+		return "Фото " + links.Photo(vkOwnerID, objectID)
+	case "video":
+		return "Видео " + links.Video(vkOwnerID, objectID)
+	case "topic":
+		return "Обсуждение " + links.Topic(vkOwnerID, objectID)
+	case "market":
+		return "Товар " + links.MarketItem(vkOwnerID, objectID)
+	default:
+		return objectType + " " + strconv.Itoa(objectID)
+	}
+}
+
+// userNames возвращает имена и ссылки первых limit пользователей
+func userNames(ctx context.Context, ids []int, limit int) string {
+	shown := ids
+	if len(shown) > limit {
+		shown = shown[:limit]
+	}
+
+	names := fetchUserNames(ctx, shown)
+	list := make([]string, len(shown))
+	for i, id := range shown {
+		if name, ok := names[id]; ok {
+			list[i] = name + " " + links.Owner(id)
+		} else {
+			list[i] = links.Owner(id)
+		}
+	}
+
+	result := strings.Join(list, ", ")
+	if rest := len(ids) - len(shown); rest > 0 {
+		result += " и еще " + strconv.Itoa(rest)
+	}
+	return result
+}
+
+// fetchUserNames получает имена пользователей одним запросом users.get
+func fetchUserNames(ctx context.Context, ids []int) map[int]string {
+	var list []string
+	for _, id := range ids {
+		if id > 0 {
+			list = append(list, strconv.Itoa(id))
+		}
+	}
+	names := map[int]string{}
+	if len(list) == 0 {
+		return names
+	}
+
+	params := url.Values{}
+	params.Set("user_ids", strings.Join(list, ","))
+
+	var users []struct {
+		ID        int    `json:"id"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	}
+	if err := callAPI(ctx, "users.get", params, &users); err != nil {
+		checkErr(ctx, err, "fetchUserNames")
+	}
+	for _, u := range users {
+		names[u.ID] = u.LastName + " " + u.FirstName
+	}
+	return names
+}
+
+func total(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
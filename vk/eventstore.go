@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Хранилище исходных событий Callback API для повторной обработки.
+// EVENT_STORE задает хранилище:
+//
+//	file:/path/events.jsonl      локальный файл (или просто путь)
+//	s3://bucket/prefix           S3-совместимое хранилище (S3_ENDPOINT, S3_REGION)
+//	sqlite:/path/events.db       SQLite, нужна сборка с тегом sqlite
+//
+// Хранилище создает initEventStore при запуске; nil — хранение отключено.
+var rawEvents eventStore
+
+// storedEvent событие в том виде, в котором оно пришло от VK
+type storedEvent struct {
+	Received time.Time       `json:"received"`
+	Type     string          `json:"type"`
+	Event    json.RawMessage `json:"event"`
+}
+
+// eventStore хранит исходные события
+type eventStore interface {
+	Append(e storedEvent) error
+	// Each передает события в порядке поступления
+	Each(fn func(e storedEvent) error) error
+}
+
+// storeEvent сохраняет исходное событие без секретного ключа, если хранилище настроено;
+// в режиме проверки события не сохраняются ни в одно хранилище
+func storeEvent(eventType string, raw json.RawMessage) {
+	if rawEvents == nil || dryRun || eventType == "confirmation" {
+		return
+	}
+	raw, err := withoutSecret(raw)
+	if err != nil {
+		log.Printf("error: не удалось сохранить событие: %v", err)
+		return
+	}
+	e := storedEvent{Received: time.Now().UTC(), Type: eventType, Event: raw}
+	if err := rawEvents.Append(e); err != nil {
+		log.Printf("error: не удалось сохранить событие: %v", err)
+	}
+}
+
+// withoutSecret убирает из события секретный ключ Callback API, остальные поля не меняются
+func withoutSecret(raw json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["secret"]; !ok {
+		return raw, nil
+	}
+	delete(fields, "secret")
+	return json.Marshal(fields)
+}
+
+// initEventStore создает хранилище событий по настройке EVENT_STORE
+func initEventStore() error {
+	config := os.Getenv("EVENT_STORE")
+	store, err := newEventStore(config)
+	if err != nil {
+		return fmt.Errorf("EVENT_STORE %q: %v", config, err)
+	}
+	rawEvents = store
+	return nil
+}
+
+// newEventStore создает хранилище по строке настройки; пустая строка отключает хранение
+func newEventStore(config string) (eventStore, error) {
+	switch {
+	case config == "":
+		return nil, nil
+	case strings.HasPrefix(config, "s3://"):
+		return newS3EventStore(strings.TrimPrefix(config, "s3://"))
+	case strings.HasPrefix(config, "sqlite:"):
+		return newSQLEventStore("sqlite3", strings.TrimPrefix(config, "sqlite:"))
+	default:
+		return fileEventStore{file: &jsonlFile{path: strings.TrimPrefix(config, "file:")}}, nil
+	}
+}
+
+// fileEventStore хранит события в файле JSON lines
+type fileEventStore struct {
+	file *jsonlFile
+}
+
+func (s fileEventStore) Append(e storedEvent) error {
+	return s.file.Append(e)
+}
+
+func (s fileEventStore) Each(fn func(e storedEvent) error) error {
+	return s.file.ReadAll(func(line []byte) error {
+		var e storedEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
+
+// s3EventStore хранит каждое событие отдельным объектом; ключи упорядочены по времени получения
+type s3EventStore struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func newS3EventStore(location string) (eventStore, error) {
+	parts := strings.SplitN(location, "/", 2)
+	if parts[0] == "" {
+		return nil, errors.New("не указан bucket")
+	}
+	store := s3EventStore{bucket: parts[0]}
+	if len(parts) == 2 && parts[1] != "" {
+		store.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+
+	cfg := aws.NewConfig().WithRegion(envOr("S3_REGION", envOr("AWS_REGION", "us-east-1")))
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		// S3-совместимые хранилища обычно работают только с адресацией по пути
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	store.client = s3.New(sess)
+	return store, nil
+}
+
+func (s s3EventStore) Append(e storedEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	key := s.prefix + e.Received.Format("2006/01/02/150405.000000000") + "-" + e.Type + ".json"
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (s s3EventStore) Each(fn func(e storedEvent) error) error {
+	var keys []string
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, aws.StringValue(o.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		out, err := s.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil {
+			return err
+		}
+		var e storedEvent
+		if err := json.Unmarshal(b, &e); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlEventStore хранит события в таблице events
+type sqlEventStore struct {
+	db *sql.DB
+}
+
+func newSQLEventStore(driver, dsn string) (eventStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		received TEXT NOT NULL,
+		type TEXT NOT NULL,
+		event TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqlEventStore{db: db}, nil
+}
+
+func (s sqlEventStore) Append(e storedEvent) error {
+	_, err := s.db.Exec(`INSERT INTO events (received, type, event) VALUES (?, ?, ?)`,
+		e.Received.Format(time.RFC3339Nano), e.Type, string(e.Event))
+	return err
+}
+
+func (s sqlEventStore) Each(fn func(e storedEvent) error) error {
+	rows, err := s.db.Query(`SELECT received, type, event FROM events ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var received, eventType, raw string
+		if err := rows.Scan(&received, &eventType, &raw); err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339Nano, received)
+		if err != nil {
+			return err
+		}
+		if err := fn(storedEvent{Received: t, Type: eventType, Event: json.RawMessage(raw)}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// Драйвер SQLite требует cgo, поэтому подключается только при сборке с тегом sqlite
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Фрагменты текста объектов, под которыми ставят лайки и оставляют комментарии
+var (
+	excerptLines = envInt("EXCERPT_LINES", 3)                  // Сколько строк текста показывать, 0 отключает фрагменты
+	excerptChars = envInt("EXCERPT_CHARS", 200)                // Максимальная длина фрагмента
+	excerptTTL   = envDuration("EXCERPT_CACHE_TTL", time.Hour) // Сколько хранить полученный текст
+
+	excerpts = excerptCache{items: map[string]cachedExcerpt{}}
+)
+
+// excerptCache кэш текстов объектов в памяти; живет, пока жив экземпляр функции
+type excerptCache struct {
+	mu    sync.Mutex
+	items map[string]cachedExcerpt
+}
+
+type cachedExcerpt struct {
+	text    string
+	expires time.Time
+}
+
+func (c *excerptCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.text, true
+}
+
+func (c *excerptCache) set(key, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items[key] = cachedExcerpt{text: text, expires: time.Now().Add(excerptTTL)}
+}
+
+// excerpt возвращает сокращенный текст объекта в виде ` «текст»` или пустую строку
+func excerpt(ctx context.Context, kind string, ownerID, id int) string {
+	if excerptLines <= 0 || id == 0 {
+		return ""
+	}
+
+	key := kind + strconv.Itoa(ownerID) + "_" + strconv.Itoa(id)
+	text, ok := excerpts.get(key)
+	if !ok {
+		var err error
+		text, err = fetchObjectText(ctx, kind, ownerID, id)
+		if err != nil {
+			log.Printf("error: не удалось получить текст %v: %v", key, err)
+			return ""
+		}
+		excerpts.set(key, text)
+	}
+
+	text = trimText(keepLines(strings.TrimSpace(text), excerptLines), excerptChars)
+	if text == "" {
+		return ""
+	}
+	return " «" + text + "»"
+}
+
+// fetchObjectText получает текст записи, фото, видео, комментария или товара
+func fetchObjectText(ctx context.Context, kind string, ownerID, id int) (string, error) {
+	fullID := strconv.Itoa(ownerID) + "_" + strconv.Itoa(id)
+	params := url.Values{}
+	params.Set("access_token", adminToken)
+
+	var method string
+	switch kind {
+	case "post":
+		method = "wall.getById"
+		params.Set("posts", fullID)
+	case "photo":
+		method = "photos.getById"
+		params.Set("photos", fullID)
+	case "video":
+		method = "video.get"
+		params.Set("videos", fullID)
+	case "comment":
+		method = "wall.getComment"
+		params.Set("owner_id", strconv.Itoa(ownerID))
+		params.Set("comment_id", strconv.Itoa(id))
+	case "market":
+		method = "market.getById"
+		params.Set("item_ids", fullID)
+	default:
+		return "", nil
+	}
+
+	var raw json.RawMessage
+	if err := callAPI(ctx, method, params, &raw); err != nil {
+		return "", err
+	}
+
+	var items []struct {
+		Text        string `json:"text"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+	if err := decodeItems(raw, &items); err != nil || len(items) == 0 {
+		return "", err
+	}
+
+	item := items[0]
+	switch {
+	case item.Title != "" && item.Description != "":
+		return item.Title + "\n" + item.Description, nil
+	case item.Title != "":
+		return item.Title, nil
+	case item.Description != "":
+		return item.Description, nil
+	}
+	return item.Text, nil
+}
+
+// decodeItems разбирает ответ, который в зависимости от метода и версии API
+// бывает массивом или объектом с полем items
+func decodeItems(raw json.RawMessage, target interface{}) error {
+	if err := json.Unmarshal(raw, target); err == nil {
+		return nil
+	}
+	var wrapped struct {
+		Items json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &wrapped); err != nil {
+		return err
+	}
+	if len(wrapped.Items) == 0 {
+		return nil
+	}
+	return json.Unmarshal(wrapped.Items, target)
+}
+
+// trimText обрезает текст до n символов
+func trimText(s string, n int) string {
+	runes := []rune(s)
+	if n <= 0 || len(runes) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:n])) + "…"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+)
+
+// Пересылка входящих личных сообщений средствами VK вместо копирования текста
+var (
+	forwardDM    = os.Getenv("FORWARD_DM") == "1" // Пересылать входящие сообщения параметром forward
+	forwardPeers []string                         // Куда пересылать (FORWARD_PEER_ID): пользователи или беседа администраторов (2000000000 + id беседы)
+)
+
+// forwardSink способ доставки, который умеет пересылать сообщения из диалога сообщества
+type forwardSink interface {
+	Forward(ctx context.Context, header string, peerID int, conversationMessageIDs []int, toPeer string) error
+}
+
+// deliverIncoming доставляет уведомление о входящих сообщениях из диалога peerID:
+// пересылает их, если включен FORWARD_DM, иначе отправляет n получателям уведомлений
+func deliverIncoming(ctx context.Context, peerID int, conversationIDs []int, header string, n notification) {
+	if forwardDM {
+		forwardIncoming(ctx, peerID, conversationIDs, header, n)
+		return
+	}
+	sendNotification(ctx, n, sendToUserID)
+	sendNotification(ctx, n, sendToUserIDControl)
+}
+
+// forwardIncoming пересылает входящие сообщения в каждый диалог из FORWARD_PEER_ID;
+// если переслать не удалось, отправляет текстовое уведомление n. В тихие часы получателя
+// вместо пересылки n попадает в утреннюю сводку.
+func forwardIncoming(ctx context.Context, peerID int, conversationIDs []int, header string, n notification) {
+	for _, peer := range forwardPeers {
+		if suppressed(ctx, peer) || deferQuiet(ctx, n, peer) {
+			continue
+		}
+		if fs, ok := sink.(forwardSink); ok && len(conversationIDs) > 0 {
+			err := traced(ctx, "deliver forward", func(ctx context.Context) error {
+				return fs.Forward(ctx, applyTemplate(header), peerID, conversationIDs, peer)
+			}, "sink", sinkName(), "peer_id", peer)
+			if err == nil {
+				continue
+			}
+			log.Printf("error: не удалось переслать сообщение в %v: %v", peer, err)
+		}
+		sendNotification(ctx, n, peer)
+	}
+}
+
+// Forward пересылает сообщения методом messages.send с параметром forward
+func (vkSink) Forward(ctx context.Context, header string, peerID int, conversationMessageIDs []int, toPeer string) error {
+	forward, err := json.Marshal(struct {
+		PeerID                 int   `json:"peer_id"`
+		ConversationMessageIDs []int `json:"conversation_message_ids"`
+	}{peerID, conversationMessageIDs})
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("peer_id", toPeer)
+	params.Set("message", header)
+	params.Set("forward", string(forward))
+	params.Set("random_id", newRandomID())
+	err = callAPI(ctx, "messages.send", params, nil)
+	stats.Inc(metricDeliveries, "sink", "vk_forward", "result", resultLabel(err))
+	return err
+}
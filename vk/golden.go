@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// useGoldenSettings задает постоянные настройки, чтобы результат не зависел от окружения,
+// и возвращает функцию, которая восстанавливает прежние
+func useGoldenSettings(apiURL, dir string) (restore func()) {
+	prevURL, prevRetries, prevVersion, prevCommunity, prevSink := vkAPI.baseURL, vkAPI.retries, vkAPIversion, currentCommunity, sink
+	prevDigest, prevDigestWindow, prevRules, prevQuiet := digestEvents, digestWindow, moderationRules, quietHours
+	prevForwardDM, prevForwardAttachments, prevTyping := forwardDM, forwardAttachments, typingWindow
+	restore = func() {
+		vkAPI.baseURL, vkAPI.retries, vkAPIversion, sink = prevURL, prevRetries, prevVersion, prevSink
+		useCommunity(prevCommunity)
+		digestEvents, digestWindow, moderationRules, quietHours = prevDigest, prevDigestWindow, prevRules, prevQuiet
+		forwardDM, forwardAttachments, typingWindow = prevForwardDM, prevForwardAttachments, prevTyping
+	}
+
+	vkAPI.baseURL, vkAPI.retries = apiURL, 0
+	vkAPIversion = minAPIVersion
+	useCommunity(community{
+		GroupID:           1,
+		Name:              "Тестовое сообщество",
+		Token:             "test-token",
+		AdminToken:        "test-admin-token",
+		ModerationToken:   "test-admin-token",
+		ConfirmationToken: "a1b2c3d4",
+		UserID:            "100",
+		UserIDControl:     "200",
+		ForwardPeerID:     "100,200",
+		DataDir:           dir,
+	})
+	digestEvents, moderationRules, quietHours = nil, nil, nil
+	forwardDM, forwardAttachments = false, true
+	typingWindow = 0
+	return restore
+}
+
+// loadGoldenResponses читает ответы поддельного API из файла {"метод": ответ}; отсутствующий
+// файл — ответов нет. Поддельный сервер в файл не входит, чтобы vktest и httptest
+// не попадали в сборку для Lambda.
+func loadGoldenResponses(file string) (map[string]json.RawMessage, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var responses map[string]json.RawMessage
+	if err := json.Unmarshal(b, &responses); err != nil {
+		return nil, errors.New(file + ": " + err.Error())
+	}
+	return responses, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/vktest"
+)
+
+var updateGolden = flag.Bool("update", false, "перезаписать эталоны в testdata/golden текущим результатом")
+
+// goldenFeatures возможности, которые включаются для событий из каталога testdata/events/<имя>.
+// События каталога обрабатываются по порядку, затем flush отправляет накопленное;
+// результат сравнивается с одним эталоном testdata/golden/<имя>.txt.
+var goldenFeatures = map[string]struct {
+	enable func()
+	flush  func(ctx context.Context) error
+}{
+	"digest": {
+		enable: func() { digestEvents, digestWindow = []string{"like_add"}, 0 },
+		flush:  func(ctx context.Context) error { return flushDigest(ctx, time.Now()) },
+	},
+	"moderation": {
+		enable: func() {
+			moderationRules = []configuredRule{
+				{name: "stopwords", rule: newStopWordsRule([]string{"казино"}), action: actionDelete},
+				{name: "links", rule: regexpRule{re: linkRe, reason: "ссылка"}, action: actionNotify},
+			}
+		},
+	},
+	"quiet": {
+		// тихие часы круглые сутки, затем выключаются, и отложенное приходит сводкой
+		enable: func() { quietHours = map[string]quietSchedule{"*": {location: time.UTC, from: 0, to: 24 * 60}} },
+		flush: func(ctx context.Context) error {
+			quietHours = nil
+			return flushQuiet(ctx, time.Now())
+		},
+	},
+	"typing": {
+		enable: func() { typingWindow = time.Minute },
+		flush:  func(ctx context.Context) error { return flushTyping(ctx, time.Now().Add(2*time.Minute)) },
+	},
+}
+
+// TestGolden прогоняет события Callback API из testdata/events через обработчики с поддельным
+// VK API и сравнивает уведомления и вызовы API с эталонами из testdata/golden.
+// Ответы поддельного API задаются в testdata/responses.json; эталоны обновляются командой
+// go test -run TestGolden -update.
+func TestGolden(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	responses, err := loadGoldenResponses(filepath.Join("testdata", "responses.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, response := range responses {
+		srv.Handle(method, response)
+	}
+
+	tmp, err := ioutil.TempDir("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer useGoldenSettings(srv.URL(), tmp)()
+
+	files, err := filepath.Glob(filepath.Join("testdata", "events", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("нет событий в testdata/events")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		got, err := goldenOutput(context.Background(), srv, []string{file}, nil)
+		checkGolden(t, name, got, err)
+	}
+
+	for name, feature := range goldenFeatures {
+		files, err := filepath.Glob(filepath.Join("testdata", "events", name, "*.json"))
+		if err != nil || len(files) == 0 {
+			t.Errorf("%v: нет событий в testdata/events/%v", name, name)
+			continue
+		}
+		// у каждого каталога свои данные, возможность включена только на время его событий
+		restore := useGoldenSettings(srv.URL(), filepath.Join(tmp, name))
+		feature.enable()
+		got, err := goldenOutput(context.Background(), srv, files, feature.flush)
+		restore()
+		checkGolden(t, name, got, err)
+	}
+}
+
+// checkGolden сравнивает результат с эталоном testdata/golden/<name>.txt или перезаписывает его
+func checkGolden(t *testing.T, name string, got []byte, err error) {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%v: %v", name, err)
+		return
+	}
+
+	goldenFile := filepath.Join("testdata", "golden", name+".txt")
+	if *updateGolden {
+		if err := ioutil.WriteFile(goldenFile, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		t.Errorf("%v: нет эталона, запустите с -update", name)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%v\n--- ожидалось\n%s--- получено\n%s", name, want, got)
+	}
+}
+
+// goldenOutput обрабатывает события из файлов по порядку, вызывает flush, если он задан,
+// и возвращает уведомления и вызовы API
+func goldenOutput(ctx context.Context, srv *vktest.Server, files []string, flush func(ctx context.Context) error) ([]byte, error) {
+	var out bytes.Buffer
+	sink = printSink{w: &out}
+	excerpts.items = map[string]cachedExcerpt{}
+	srv.Reset()
+
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var event vkEvents
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		result, err := handleLambdaEvent(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&out, "= %v\n", result)
+	}
+	if flush != nil {
+		fmt.Fprintln(&out, "~ отправка накопленного")
+		if err := flush(ctx); err != nil {
+			return nil, err
+		}
+	}
+	for _, call := range srv.Calls() {
+		fmt.Fprintf(&out, "# %v\n", call)
+	}
+	return out.Bytes(), nil
+}
+
+// useTestSettings задает настройки эталонных тестов с поддельным VK API и пустым каталогом
+// данных; уведомления печатаются в out. Прежние настройки восстанавливаются в конце теста.
+func useTestSettings(t *testing.T, out *bytes.Buffer) *vktest.Server {
+	srv := vktest.NewServer()
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := useGoldenSettings(srv.URL(), dir)
+	sink = printSink{w: out}
+	t.Cleanup(func() {
+		restore()
+		srv.Close()
+		os.RemoveAll(dir)
+	})
+	return srv
+}
+
+// testEvent разбирает событие Callback API из JSON
+func testEvent(t *testing.T, raw string) vkEvents {
+	t.Helper()
+	var event vkEvents
+	if err := json.Unmarshal([]byte(raw), &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
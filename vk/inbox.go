@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Контроль ответов на личные сообщения: неотвеченные сообщения эскалируются,
+// время ответа записывается для отчета по администраторам
+var (
+	escalateAfter      = envDuration("ESCALATE_AFTER", 30*time.Minute)                  // Через сколько эскалировать сообщение без ответа
+	escalateAfterHigh  = envDuration("ESCALATE_AFTER_HIGH", 10*time.Minute)             // То же для сообщений с высоким приоритетом
+	escalateTo         = splitList(os.Getenv("ESCALATE_TO"))                            // Кому отправлять эскалации, по умолчанию USERID_CONTROL
+	priorityKeywords   = splitList(envOr("PRIORITY_KEYWORDS", "срочно,жалоба,возврат")) // Слова, при которых сообщение получает высокий приоритет
+	responseReportDays = envInt("RESPONSE_REPORT_DAYS", 7)                              // За сколько дней строить отчет о времени ответа
+	responseReportTick = envDuration("RESPONSE_REPORT_INTERVAL", 7*24*time.Hour)        // Как часто отправлять отчет о времени ответа
+	inboxState         = dataPath("inbox.json")                                         // Сообщения, ожидающие ответа
+	responseLog        = newResponseStore(dataPath("responses.jsonl"))                  // Время ответа на сообщения
+)
+
+// Приоритеты сообщений
+const (
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
+// pendingMessage диалог, в котором пользователь ждет ответа
+type pendingMessage struct {
+	PeerID    int         `json:"peer_id"`
+	Time      time.Time   `json:"time"` // время первого неотвеченного сообщения
+	Text      string      `json:"text"`
+	Count     int         `json:"count"`              // сколько сообщений пришло без ответа
+	Received  []time.Time `json:"received,omitempty"` // время сообщений без ответа
+	Priority  string      `json:"priority"`
+	Escalated bool        `json:"escalated,omitempty"`
+}
+
+// deadline время, после которого сообщение эскалируется
+func (p pendingMessage) deadline() time.Time {
+	if p.Priority == priorityHigh {
+		return p.Time.Add(escalateAfterHigh)
+	}
+	return p.Time.Add(escalateAfter)
+}
+
+// responseRecord ответ администратора на сообщение
+type responseRecord struct {
+	Time      time.Time   `json:"time"`
+	AdminID   int         `json:"admin_id"` // 0, если ответ отправлен через API
+	PeerID    int         `json:"peer_id"`
+	Priority  string      `json:"priority"`
+	Seconds   float64     `json:"seconds"` // ожидание с первого сообщения без ответа
+	Escalated bool        `json:"escalated,omitempty"`
+	Received  []time.Time `json:"received,omitempty"` // время сообщений, на которые дан ответ
+}
+
+// responseStore хранит ответы на сообщения
+type responseStore interface {
+	Add(r responseRecord) error
+	// Since возвращает ответы начиная с from в порядке поступления
+	Since(from time.Time) ([]responseRecord, error)
+}
+
+// fileResponseStore хранит ответы в файле JSON lines
+type fileResponseStore struct {
+	file *jsonlFile
+}
+
+func newResponseStore(path string) responseStore {
+	return fileResponseStore{file: &jsonlFile{path: path}}
+}
+
+func (s fileResponseStore) Add(r responseRecord) error {
+	return s.file.Append(r)
+}
+
+func (s fileResponseStore) Since(from time.Time) ([]responseRecord, error) {
+	var list []responseRecord
+	err := s.file.ReadAll(func(line []byte) error {
+		var r responseRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if !r.Time.Before(from) {
+			list = append(list, r)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// messagePriority определяет приоритет входящего сообщения по словам и автору
+func messagePriority(fromID int, text string) string {
+	lower := strings.ToLower(text)
+	for _, word := range priorityKeywords {
+		if strings.Contains(lower, strings.ToLower(word)) {
+			return priorityHigh
+		}
+	}
+	if contains(vipUsers, strconv.Itoa(fromID)) {
+		return priorityHigh
+	}
+	return priorityNormal
+}
+
+// eventTime время события из поля date или текущее время
+func eventTime(date int) time.Time {
+	if date > 0 {
+		return time.Unix(int64(date), 0).UTC()
+	}
+	return time.Now().UTC()
+}
+
+// loadInbox читает сообщения, ожидающие ответа, по идентификатору диалога
+func loadInbox() (map[string]pendingMessage, error) {
+	inbox := map[string]pendingMessage{}
+	err := loadJSON(inboxState, &inbox)
+	return inbox, err
+}
+
+// trackIncoming отмечает, что пользователь ждет ответа; время ожидания считается от первого сообщения
+func trackIncoming(ctx context.Context, event vkEvents, priority string) {
+	m := event.Object.Message
+	if !isUserDialog(m.PeerID) || m.FromID != m.PeerID {
+		return
+	}
+	peer := strconv.Itoa(m.PeerID)
+	inbox := map[string]pendingMessage{}
+	checkErr(ctx, updateJSON(inboxState, &inbox, func() (bool, error) {
+		p, ok := inbox[peer]
+		if !ok {
+			p = pendingMessage{PeerID: m.PeerID, Time: eventTime(m.Date), Text: m.Text, Priority: priority}
+		}
+		p.Count++
+		p.Received = append(p.Received, eventTime(m.Date))
+		if priority == priorityHigh {
+			p.Priority = priorityHigh
+		}
+		inbox[peer] = p
+		return true, nil
+	}), "trackIncoming")
+}
+
+// trackReply записывает время ответа, если в диалоге ждали ответа
+func trackReply(ctx context.Context, event vkEvents) {
+	if !isUserDialog(event.Object.PeerID) {
+		// уведомления администраторам и сообщения в беседы не учитываем
+		return
+	}
+	replied := eventTime(event.Object.Date)
+	peer := strconv.Itoa(event.Object.PeerID)
+	inbox := map[string]pendingMessage{}
+	err := updateJSON(inboxState, &inbox, func() (bool, error) {
+		p, ok := inbox[peer]
+		if !ok {
+			return false, nil
+		}
+		delete(inbox, peer)
+
+		r := responseRecord{
+			Time:      replied,
+			AdminID:   event.Object.AdminAuthor,
+			PeerID:    p.PeerID,
+			Priority:  p.Priority,
+			Seconds:   replied.Sub(p.Time).Seconds(),
+			Escalated: p.Escalated,
+			Received:  p.Received,
+		}
+		return true, responseLog.Add(r)
+	})
+	if err != nil {
+		// не checkErr: уведомление об ошибке — тоже исходящее сообщение и снова попало бы сюда
+		log.Printf("error: trackReply: %v", err)
+	}
+}
+
+// isUserDialog проверяет, что диалог — личная переписка пользователя с сообществом, а не беседа
+// и не диалог с администратором, куда приходят уведомления
+func isUserDialog(peerID int) bool {
+	return peerID > 0 && peerID < 2000000000 && !isAdmin(peerID)
+}
+
+// isAdmin проверяет, что пользователь получает уведомления сообщества
+func isAdmin(userID int) bool {
+	id := strconv.Itoa(userID)
+	return id == sendToUserID || id == sendToUserIDControl
+}
+
+// escalateUnanswered задача по расписанию: сообщает о сообщениях, оставшихся без ответа дольше порога
+func escalateUnanswered(ctx context.Context, now time.Time) error {
+	inbox := map[string]pendingMessage{}
+	return updateJSON(inboxState, &inbox, func() (bool, error) {
+		var peers []string
+		for peer, p := range inbox {
+			if !p.Escalated && !now.Before(p.deadline()) {
+				peers = append(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			return false, nil
+		}
+		sort.Strings(peers)
+		escalate(ctx, inbox, peers, now)
+		return true, nil
+	})
+}
+
+// escalate отправляет эскалации по диалогам peers и отмечает их в inbox
+func escalate(ctx context.Context, inbox map[string]pendingMessage, peers []string, now time.Time) {
+
+	for _, peer := range peers {
+		p := inbox[peer]
+		message := "Нет ответа " + formatWait(now.Sub(p.Time)) + " на сообщение от " + links.Owner(p.PeerID) +
+			": " + trimText(p.Text, 200) + " " + links.Dialog(-vkOwnerID, p.PeerID)
+		if p.Count > 1 {
+			message += " (сообщений без ответа: " + strconv.Itoa(p.Count) + ")"
+		}
+		sendCtx := ctx
+		if p.Priority == priorityHigh {
+			message = "[высокий приоритет] " + message
+			sendCtx = withUrgent(ctx, true)
+		}
+		for _, to := range escalationPeers() {
+			sendMessage(sendCtx, message, to)
+		}
+		p.Escalated = true
+		inbox[peer] = p
+	}
+}
+
+// escalationPeers получатели эскалаций текущего сообщества
+func escalationPeers() []string {
+	if len(escalateTo) > 0 {
+		return escalateTo
+	}
+	return []string{sendToUserIDControl}
+}
+
+// formatWait описывает время ожидания в минутах или часах
+func formatWait(d time.Duration) string {
+	if d < time.Hour {
+		return strconv.Itoa(int(d.Minutes())) + " мин."
+	}
+	return fmt.Sprintf("%.1f ч.", d.Hours())
+}
+
+// sendResponseReport отправляет администраторам отчет о времени ответа по расписанию
+func sendResponseReport(ctx context.Context, now time.Time) error {
+	report, err := responseReport(ctx, now, responseReportDays)
+	if err != nil {
+		return err
+	}
+	sendMessage(ctx, report, sendToUserID)
+	sendMessage(ctx, report, sendToUserIDControl)
+	return nil
+}
+
+// adminStats время ответа одного администратора
+type adminStats struct {
+	adminID  int
+	answered int
+	inTime   int // ответы до порога эскалации
+	total    float64
+	max      float64
+}
+
+// responseReport считает число диалогов и сообщений, время первого ответа и решения, сообщения
+// по дням и часы пик, а по каждому администратору — число ответов, среднее и максимальное
+// время ответа и долю ответов до порога эскалации
+func responseReport(ctx context.Context, now time.Time, days int) (string, error) {
+	now = now.In(responseLocation)
+	from := startOfDay(now).AddDate(0, 0, -days+1)
+	// ответы в диалогах, начатых до периода, нужны, чтобы не принять их продолжение за новые
+	list, err := responseLog.Since(from.Add(-conversationIdle))
+	if err != nil {
+		return "", err
+	}
+	inbox, err := loadInbox()
+	if err != nil {
+		return "", err
+	}
+
+	byAdmin := map[int]*adminStats{}
+	var admins []int
+	for _, r := range list {
+		if r.Time.Before(from) {
+			continue
+		}
+		s, ok := byAdmin[r.AdminID]
+		if !ok {
+			s = &adminStats{adminID: r.AdminID}
+			byAdmin[r.AdminID] = s
+			admins = append(admins, r.AdminID)
+		}
+		s.answered++
+		s.total += r.Seconds
+		if r.Seconds > s.max {
+			s.max = r.Seconds
+		}
+		limit := escalateAfter
+		if r.Priority == priorityHigh {
+			limit = escalateAfterHigh
+		}
+		if r.Seconds <= limit.Seconds() {
+			s.inTime++
+		}
+	}
+	sort.Slice(admins, func(i, j int) bool {
+		return byAdmin[admins[i]].answered > byAdmin[admins[j]].answered
+	})
+
+	lines := []string{"Личные сообщения и время ответа за " + strconv.Itoa(days) + " дн."}
+	lines = append(lines, conversationLines(now, from, days, list, inbox)...)
+	lines = append(lines, "Администраторы:")
+	names := fetchUserNames(ctx, admins)
+	for _, id := range admins {
+		s := byAdmin[id]
+		name := "через API"
+		if id > 0 {
+			name = strings.TrimSpace(names[id] + " " + links.User(id))
+		}
+		lines = append(lines, fmt.Sprintf("%v: ответов %d, в среднем %v, максимум %v, вовремя %d%%",
+			name, s.answered, formatWait(time.Duration(s.total/float64(s.answered))*time.Second),
+			formatWait(time.Duration(s.max)*time.Second), s.inTime*100/s.answered))
+	}
+	if len(admins) == 0 {
+		lines = append(lines, "ответов не было")
+	}
+	if len(inbox) > 0 {
+		lines = append(lines, "Сейчас без ответа: "+strconv.Itoa(len(inbox)))
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Рейтинг самых активных участников сообщества
+var (
+	activityEvents  = newActivityStore(dataPath("activity.jsonl"))
+	activityWeights = parseWeights(envOr("LEADERBOARD_WEIGHTS", "like_add:1,like_remove:-1,wall_reply_new:3,wall_repost:5,board_post_new:3,poll_vote_new:1")) // Баллы за каждый тип события
+	leaderboardTop  = envInt("LEADERBOARD_TOP", 10)                                                                                                           // Сколько участников показывать в рейтинге
+	leaderboardPost = os.Getenv("LEADERBOARD_POST")                                                                                                           // Куда публиковать благодарность: wall или topic:<id обсуждения>
+)
+
+// activity действие участника, за которое начисляются баллы
+type activity struct {
+	Time   time.Time `json:"time"`
+	UserID int       `json:"user_id"`
+	Type   string    `json:"type"`
+}
+
+// activityStore хранит действия участников
+type activityStore interface {
+	Add(a activity) error
+	// Between возвращает действия в интервале [from, to)
+	Between(from, to time.Time) ([]activity, error)
+}
+
+// fileActivityStore хранит действия в файле JSON lines
+type fileActivityStore struct {
+	file *jsonlFile
+}
+
+func newActivityStore(path string) activityStore {
+	return fileActivityStore{file: &jsonlFile{path: path}}
+}
+
+func (s fileActivityStore) Add(a activity) error {
+	return s.file.Append(a)
+}
+
+func (s fileActivityStore) Between(from, to time.Time) ([]activity, error) {
+	var list []activity
+	err := s.file.ReadAll(func(line []byte) error {
+		var a activity
+		if err := json.Unmarshal(line, &a); err != nil {
+			return err
+		}
+		if !a.Time.Before(from) && a.Time.Before(to) {
+			list = append(list, a)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// recordActivity сохраняет действие участника, если за этот тип события начисляются баллы
+func recordActivity(ctx context.Context, event vkEvents) {
+	if _, ok := activityWeights[event.Type]; !ok {
+		return
+	}
+
+	var userID int
+	switch event.Type {
+	case "like_add", "like_remove":
+		userID = event.Object.LikerID
+	case "poll_vote_new":
+		userID = event.Object.UserID
+	default:
+		userID = event.Object.FromID
+	}
+	if userID <= 0 {
+		// действия от имени сообщества не учитываем
+		return
+	}
+
+	checkErr(ctx, activityEvents.Add(activity{Time: time.Now().UTC(), UserID: userID, Type: event.Type}), "recordActivity")
+}
+
+// score баллы участника
+type score struct {
+	UserID int
+	Points int
+}
+
+// leaderboard считает баллы участников за период и возвращает лучших
+func leaderboard(from, to time.Time, top int) ([]score, error) {
+	list, err := activityEvents.Between(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	points := map[int]int{}
+	for _, a := range list {
+		points[a.UserID] += activityWeights[a.Type]
+	}
+
+	var scores []score
+	for userID, p := range points {
+		if p > 0 {
+			scores = append(scores, score{UserID: userID, Points: p})
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Points != scores[j].Points {
+			return scores[i].Points > scores[j].Points
+		}
+		return scores[i].UserID < scores[j].UserID
+	})
+	if len(scores) > top {
+		scores = scores[:top]
+	}
+	return scores, nil
+}
+
+// leaderboardReport формирует рейтинг для администраторов
+func leaderboardReport(ctx context.Context, title string, from, to time.Time) (string, []score, error) {
+	scores, err := leaderboard(from, to, leaderboardTop)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(scores) == 0 {
+		return title + ": активности не было", nil, nil
+	}
+
+	ids := make([]int, len(scores))
+	for i, s := range scores {
+		ids[i] = s.UserID
+	}
+	names := fetchUserNames(ctx, ids)
+
+	lines := []string{title + ":"}
+	for i, s := range scores {
+		lines = append(lines, strconv.Itoa(i+1)+". "+names[s.UserID]+" "+links.User(s.UserID)+" — "+strconv.Itoa(s.Points))
+	}
+	return strings.Join(lines, "\n"), scores, nil
+}
+
+func weeklyLeaderboard(ctx context.Context, now time.Time) error {
+	return sendLeaderboard(ctx, "Самые активные участники за неделю", now.AddDate(0, 0, -7), now)
+}
+
+func monthlyLeaderboard(ctx context.Context, now time.Time) error {
+	return sendLeaderboard(ctx, "Самые активные участники за месяц", now.AddDate(0, -1, 0), now)
+}
+
+// sendLeaderboard отправляет рейтинг администраторам и, если настроено, благодарит участников публично
+func sendLeaderboard(ctx context.Context, title string, from, to time.Time) error {
+	report, scores, err := leaderboardReport(ctx, title, from, to)
+	if err != nil {
+		return err
+	}
+	sendMessage(ctx, report, sendToUserID)
+	sendMessage(ctx, report, sendToUserIDControl)
+
+	if leaderboardPost == "" || len(scores) == 0 {
+		return nil
+	}
+	return postThanks(ctx, title, scores)
+}
+
+// postThanks публикует благодарность лучшим участникам на стене или в обсуждении
+func postThanks(ctx context.Context, title string, scores []score) error {
+	ids := make([]int, len(scores))
+	for i, s := range scores {
+		ids[i] = s.UserID
+	}
+	names := fetchUserNames(ctx, ids)
+
+	var mentions []string
+	for _, s := range scores {
+		name := names[s.UserID]
+		if name == "" {
+			name = "id" + strconv.Itoa(s.UserID)
+		}
+		// упоминание вида [id123|Имя Фамилия]
+		mentions = append(mentions, "[id"+strconv.Itoa(s.UserID)+"|"+name+"]")
+	}
+	message := title + ". Спасибо вам!\n" + strings.Join(mentions, "\n")
+
+	params := url.Values{}
+	params.Set("access_token", adminToken)
+	params.Set("message", message)
+	params.Set("from_group", "1")
+
+	switch {
+	case leaderboardPost == "wall":
+		params.Set("owner_id", strconv.Itoa(vkOwnerID))
+		return callAPI(ctx, "wall.post", params, nil)
+	case strings.HasPrefix(leaderboardPost, "topic:"):
+		params.Set("group_id", vkGroupID)
+		params.Set("topic_id", strings.TrimPrefix(leaderboardPost, "topic:"))
+		return callAPI(ctx, "board.createComment", params, nil)
+	default:
+		log.Printf("error: неизвестное значение LEADERBOARD_POST %q", leaderboardPost)
+		return nil
+	}
+}
+
+// parseWeights разбирает настройку вида "like_add:1,wall_reply_new:3"
+func parseWeights(config string) map[string]int {
+	weights := map[string]int{}
+	for _, item := range splitList(config) {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			log.Printf("error: неверный вес %q, ожидается тип:баллы", item)
+			continue
+		}
+		w, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Printf("error: неверный вес %q: %v", item, err)
+			continue
+		}
+		weights[parts[0]] = w
+	}
+	return weights
+}
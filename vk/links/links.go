@@ -0,0 +1,103 @@
+// Package links строит канонические ссылки на объекты ВКонтакте.
+//
+// Идентификаторы владельцев передаются так, как их возвращает API:
+// положительные для пользователей, отрицательные для сообществ.
+package links
+
+import "strconv"
+
+// Base адрес сайта ВКонтакте
+const Base = "https://vk.com/"
+
+// Owner возвращает ссылку на пользователя или сообщество:
+// Owner(1) = https://vk.com/id1, Owner(-1) = https://vk.com/club1
+func Owner(ownerID int) string {
+	if ownerID < 0 {
+		return Community(-ownerID)
+	}
+	return User(ownerID)
+}
+
+// User возвращает ссылку на пользователя: User(1) = https://vk.com/id1
+func User(userID int) string {
+	return Base + "id" + strconv.Itoa(userID)
+}
+
+// Community возвращает ссылку на сообщество по положительному идентификатору: Community(1) = https://vk.com/club1
+func Community(groupID int) string {
+	return Base + "club" + strconv.Itoa(groupID)
+}
+
+// WallPost возвращает ссылку на запись: WallPost(-1, 2) = https://vk.com/wall-1_2
+func WallPost(ownerID, postID int) string {
+	return object("wall", ownerID, postID)
+}
+
+// WallComment возвращает ссылку на комментарий к записи: WallComment(-1, 2, 3) = https://vk.com/wall-1_2?reply=3
+func WallComment(ownerID, postID, commentID int) string {
+	return WallPost(ownerID, postID) + "?reply=" + strconv.Itoa(commentID)
+}
+
+// Photo возвращает ссылку на фотографию: Photo(-1, 2) = https://vk.com/photo-1_2
+func Photo(ownerID, photoID int) string {
+	return object("photo", ownerID, photoID)
+}
+
+// PhotoComment возвращает ссылку на комментарий к фотографии: PhotoComment(-1, 2, 3) = https://vk.com/photo-1_2?reply=3
+func PhotoComment(ownerID, photoID, commentID int) string {
+	return Photo(ownerID, photoID) + "?reply=" + strconv.Itoa(commentID)
+}
+
+// Album возвращает ссылку на фотоальбом: Album(-1, 2) = https://vk.com/album-1_2
+func Album(ownerID, albumID int) string {
+	return object("album", ownerID, albumID)
+}
+
+// Video возвращает ссылку на видеозапись: Video(-1, 2) = https://vk.com/video-1_2
+func Video(ownerID, videoID int) string {
+	return object("video", ownerID, videoID)
+}
+
+// VideoComment возвращает ссылку на комментарий к видеозаписи: VideoComment(-1, 2, 3) = https://vk.com/video-1_2?reply=3
+func VideoComment(ownerID, videoID, commentID int) string {
+	return Video(ownerID, videoID) + "?reply=" + strconv.Itoa(commentID)
+}
+
+// Topic возвращает ссылку на обсуждение: Topic(-1, 2) = https://vk.com/topic-1_2
+func Topic(ownerID, topicID int) string {
+	return object("topic", ownerID, topicID)
+}
+
+// TopicComment возвращает ссылку на сообщение в обсуждении: TopicComment(-1, 2, 3) = https://vk.com/topic-1_2?post=3
+func TopicComment(ownerID, topicID, commentID int) string {
+	return Topic(ownerID, topicID) + "?post=" + strconv.Itoa(commentID)
+}
+
+// MarketItem возвращает ссылку на товар: MarketItem(-1, 2) = https://vk.com/product-1_2
+func MarketItem(ownerID, itemID int) string {
+	return object("product", ownerID, itemID)
+}
+
+// MarketComment возвращает ссылку на комментарий к товару: MarketComment(-1, 2, 3) = https://vk.com/product-1_2?reply=3
+func MarketComment(ownerID, itemID, commentID int) string {
+	return MarketItem(ownerID, itemID) + "?reply=" + strconv.Itoa(commentID)
+}
+
+// Poll возвращает ссылку на опрос: Poll(-1, 2) = https://vk.com/poll-1_2
+func Poll(ownerID, pollID int) string {
+	return object("poll", ownerID, pollID)
+}
+
+func object(kind string, ownerID, id int) string {
+	return Base + kind + strconv.Itoa(ownerID) + "_" + strconv.Itoa(id)
+}
+
+// Doc возвращает ссылку на документ: Doc(1, 2) = https://vk.com/doc1_2
+func Doc(ownerID, docID int) string {
+	return object("doc", ownerID, docID)
+}
+
+// Dialog возвращает ссылку на диалог сообщества с пользователем: Dialog(1, 2) = https://vk.com/gim1?sel=2
+func Dialog(groupID, userID int) string {
+	return Base + "gim" + strconv.Itoa(groupID) + "?sel=" + strconv.Itoa(userID)
+}
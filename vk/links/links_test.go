@@ -0,0 +1,34 @@
+package links
+
+import "testing"
+
+func TestLinks(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{Owner(1), "https://vk.com/id1"},
+		{Owner(-1), "https://vk.com/club1"},
+		{User(555), "https://vk.com/id555"},
+		{Community(1), "https://vk.com/club1"},
+		{WallPost(-1, 35), "https://vk.com/wall-1_35"},
+		{WallPost(555, 2), "https://vk.com/wall555_2"},
+		{WallComment(-1, 35, 7), "https://vk.com/wall-1_35?reply=7"},
+		{Photo(-1, 457239017), "https://vk.com/photo-1_457239017"},
+		{PhotoComment(-1, 457239017, 4), "https://vk.com/photo-1_457239017?reply=4"},
+		{Album(-1, 280), "https://vk.com/album-1_280"},
+		{Video(-1, 456239018), "https://vk.com/video-1_456239018"},
+		{VideoComment(-1, 456239018, 5), "https://vk.com/video-1_456239018?reply=5"},
+		{Topic(-1, 2), "https://vk.com/topic-1_2"},
+		{TopicComment(-1, 2, 3), "https://vk.com/topic-1_2?post=3"},
+		{MarketItem(-1, 10), "https://vk.com/product-1_10"},
+		{MarketComment(-1, 10, 6), "https://vk.com/product-1_10?reply=6"},
+		{Poll(-1, 5), "https://vk.com/poll-1_5"},
+		{Doc(555, 2), "https://vk.com/doc555_2"},
+		{Dialog(1, 555), "https://vk.com/gim1?sel=555"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("получено %v, ожидалось %v", tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Структурированные логи: все вызовы log.Printf проходят через logWriter, который
+// определяет уровень по префиксу сообщения, убирает ключи доступа и пишет JSON для CloudWatch
+var (
+	logLevel  = levelByName(envOr("LOG_LEVEL", "info")) // Минимальный уровень: debug, info, warn, error
+	logFormat = envOr("LOG_FORMAT", defaultLogFormat()) // json или text
+)
+
+// Уровни логирования
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func levelByName(name string) int {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return levelInfo
+}
+
+// defaultLogFormat JSON в Lambda, текст при запуске из командной строки
+func defaultLogFormat() string {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		return "json"
+	}
+	return "text"
+}
+
+// logFields поля обрабатываемого события, которые добавляются к каждой записи
+var (
+	logFields   = map[string]interface{}{}
+	logFieldsMu sync.Mutex
+)
+
+// setLogFields задает поля события для последующих записей; nil очищает их
+func setLogFields(fields map[string]interface{}) {
+	logFieldsMu.Lock()
+	defer logFieldsMu.Unlock()
+	logFields = map[string]interface{}{}
+	for k, v := range fields {
+		logFields[k] = v
+	}
+}
+
+// logWriter получатель стандартного логгера
+type logWriter struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func newLogWriter(out io.Writer) *logWriter {
+	return &logWriter{out: out}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\r\n")
+	level, message := splitLevel(line)
+	w.write(level, message, nil)
+	return len(p), nil
+}
+
+// logger получатель стандартного логгера; подключается в main
+var logger = newLogWriter(os.Stderr)
+
+// logWith пишет запись с дополнительными полями, например latency_ms
+func logWith(level int, message string, fields map[string]interface{}) {
+	logger.write(level, message, fields)
+}
+
+func (w *logWriter) write(level int, message string, fields map[string]interface{}) {
+	if level < logLevel {
+		return
+	}
+	message = redact(message)
+
+	entry := map[string]interface{}{}
+	logFieldsMu.Lock()
+	for k, v := range logFields {
+		entry[k] = v
+	}
+	logFieldsMu.Unlock()
+	for k, v := range fields {
+		entry[k] = v
+	}
+
+	var b []byte
+	if logFormat == "json" {
+		entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		entry["level"] = levelNames[level]
+		entry["msg"] = message
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(entry)
+		b = bytes.TrimRight(buf.Bytes(), "\n")
+	} else {
+		text := time.Now().Format("2006/01/02 15:04:05") + " " + strings.ToUpper(levelNames[level]) + " " + message
+		var keys []string
+		for k := range entry {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f, _ := json.Marshal(entry[k])
+			text += " " + k + "=" + string(f)
+		}
+		b = []byte(text)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.out.Write(append(b, '\n'))
+}
+
+// splitLevel определяет уровень по префиксу сообщения: "error:", "warn:", "debug:"
+func splitLevel(line string) (int, string) {
+	for level, name := range levelNames {
+		if strings.HasPrefix(line, name+":") {
+			return level, strings.TrimSpace(strings.TrimPrefix(line, name+":"))
+		}
+	}
+	return levelInfo, line
+}
+
+// Ключи доступа в параметрах запросов, JSON и адресах Bot API
+var (
+	redactParamRe    = regexp.MustCompile(`(?i)((?:access_token|token|secret|confirmation_token)=)[^&\s"]+`)
+	redactJSONRe     = regexp.MustCompile(`(?i)("(?:access_token|token|secret|confirmation_token|admin_token|moderation_token)"\s*:\s*)"[^"]*"`)
+	redactTelegramRe = regexp.MustCompile(`/bot[0-9]+:[\w-]+`)
+)
+
+const redacted = "[REDACTED]"
+
+// redact убирает из сообщения ключи доступа и секреты
+func redact(s string) string {
+	s = redactParamRe.ReplaceAllString(s, "${1}"+redacted)
+	s = redactJSONRe.ReplaceAllString(s, `${1}"`+redacted+`"`)
+	s = redactTelegramRe.ReplaceAllString(s, "/bot"+redacted)
+	for _, secret := range secretValues() {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+// secretValues известные значения ключей; короткие не заменяются, чтобы не портить обычный текст
+func secretValues() []string {
+	list := []string{token, adminToken, moderationToken, telegramToken}
+	for _, c := range communities {
+		list = append(list, c.Token, c.AdminToken, c.ModerationToken, c.Secret)
+	}
+	var values []string
+	for _, v := range list {
+		if len(v) >= 8 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	prevToken, prevCommunities := token, communities
+	defer func() { token, communities = prevToken, prevCommunities }()
+	token = "vk1.a.community-token"
+	communities = []community{{GroupID: 5, Secret: "callback-secret"}, {GroupID: 6, Secret: "short"}}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"нет секретов", "нет секретов"},
+		{"POST /method/users.get?access_token=abc123&v=5.131", "POST /method/users.get?access_token=[REDACTED]&v=5.131"},
+		{"confirmation_token=xyz secret=s1", "confirmation_token=[REDACTED] secret=[REDACTED]"},
+		{`{"token": "abc", "admin_token":"def", "text": "token"}`, `{"token": "[REDACTED]", "admin_token":"[REDACTED]", "text": "token"}`},
+		{"https://api.telegram.org/bot123456:AA-bb_CC/sendMessage", "https://api.telegram.org/bot[REDACTED]/sendMessage"},
+		// известные значения заменяются в любом месте сообщения
+		{"ключ vk1.a.community-token не подошел", "ключ [REDACTED] не подошел"},
+		{"событие с ключом callback-secret", "событие с ключом [REDACTED]"},
+		// короткие значения не заменяются, чтобы не портить обычный текст
+		{"short text", "short text"},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, ожидалось %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -1,72 +1,110 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
 )
 
-// using VK Callback API
+// using VK Callback API; основные настройки заполняет initConfig при запуске
 var (
-	confirmationToken   = os.Getenv("CONFIRMATION_TOKEN")
-	token               = os.Getenv("TOKEN")
+	confirmationToken   string
+	token               string
+	adminToken          string // Ключ администратора для методов, недоступных ключу сообщества
 	errorBackend        = errors.New("\"Something went wrong\"")
 	myClient            = &http.Client{Timeout: 60 * time.Second}
-	vkAPIversion        = os.Getenv("VKAPI")          // Версия API
-	sendToUserID        = os.Getenv("USERID")         // Пользователь, которому будут отправляться уведомления
-	sendToUserIDControl = os.Getenv("USERID_CONTROL") // Дополнительно отправлять сообщения пользователю
-	vkGroupID           = os.Getenv("GROUP_ID")       // Идентификатор группы
-	vkGroupName         = os.Getenv("GROUP_NAME")     // Название группы
-
-	vkWallID       = vkGroupName + "?w=wall-" + vkGroupID + "_"  // Идентификатор стены в формате xxx?w=wall-xxx_
-	vkPhotoAlbumID = "photo-" + vkGroupID + "_"                  // Идентификатор фотоальбома в формате photo-xxx_
-	vkVideoID      = vkGroupName + "?z=video-" + vkGroupID + "_" // Идентификатор видео
-	vkPhotoID      = vkGroupName + "?z=photo-" + vkGroupID + "_" // Идентификатор фото
-	vkTopicID      = "https://vk.com/topic-" + vkGroupID + "_"
+	vkAPIversion        string // Версия API
+	sendToUserID        string // Пользователь, которому будут отправляться уведомления
+	sendToUserIDControl string // Дополнительно отправлять сообщения пользователю
+	vkGroupID           string // Идентификатор группы
+	vkGroupName         string // Название группы
+	vkOwnerID           int    // Идентификатор группы как владельца объектов (отрицательный)
 )
 
 type vkEvents struct {
 	Type   string `json:"type"`
 	Object struct {
-		UserID     int      `json:"user_id"`  // для фото
-		FromID     int      `json:"from_id"`  // для комментариев
-		OwnerID    int      `json:"owner_id"` // для аудио и видео
-		LikerID    int      `json:"liker_id"` // для лайков
-		ID         int      `json:"id"`       // идентификатор фото или комментария
-		PhotoID    int      `json:"photo_id"`
-		PostID     int      `json:"post_id"`
-		TopicID    int      `json:"topic_id"`
-		ItemID     int      `json:"item_id"`
-		PollID     int      `json:"poll_id"`
-		Title      string   `json:"title"`       // название композиции.
-		ObjectType string   `json:"object_type"` // для лайков
-		ObjectID   int      `json:"object_id"`
-		JoinType   string   `json:"join_type"`
-		AlbumID    int      `json:"album_id"` // идентификатор альбома, в котором находится фотография
-		Text       string   `json:"text"`     // текст описания
-		Message    struct { // Личное сообщение
-			ID     int    `json:"id"`      // идентификатор сообщения
-			Date   int    `json:"date"`    // время отправки в Unixtime
-			FromID int    `json:"from_id"` // идентификатор отправителя
-			Text   string `json:"text"`    // текст сообщения
+		UserID      int      `json:"user_id"`  // для фото
+		FromID      int      `json:"from_id"`  // для комментариев
+		OwnerID     int      `json:"owner_id"` // для аудио и видео
+		LikerID     int      `json:"liker_id"` // для лайков
+		ID          int      `json:"id"`       // идентификатор фото или комментария
+		PhotoID     int      `json:"photo_id"`
+		PhotoOwner  int      `json:"photo_owner_id"`  // владелец фото для комментариев к фото
+		TopicOwner  int      `json:"topic_owner_id"`  // владелец обсуждения
+		MarketOwner int      `json:"market_owner_id"` // владелец товара
+		PostID      int      `json:"post_id"`
+		TopicID     int      `json:"topic_id"`
+		ItemID      int      `json:"item_id"`
+		PollID      int      `json:"poll_id"`
+		Title       string   `json:"title"`       // название композиции.
+		ObjectType  string   `json:"object_type"` // для лайков
+		ObjectID    int      `json:"object_id"`
+		ObjectOwner int      `json:"object_owner_id"` // владелец объекта, для лайков
+		JoinType    string   `json:"join_type"`
+		Self        int      `json:"self"`            // 1, если участник вышел сам
+		AlbumID     int      `json:"album_id"`        // идентификатор альбома, в котором находится фотография
+		Text        string   `json:"text"`            // текст описания
+		PostType    string   `json:"post_type"`       // тип записи: post, copy, reply, postpone, suggest
+		PeerID      int      `json:"peer_id"`         // диалог, для исходящего сообщения message_reply
+		Date        int      `json:"date"`            // время исходящего сообщения в Unixtime
+		AdminAuthor int      `json:"admin_author_id"` // администратор, ответивший от имени сообщества
+		RandomID    int      `json:"random_id"`       // random_id исходящего сообщения
+		State       string   `json:"state"`           // typing для message_typing_state
+		Message     struct { // Личное сообщение
+			ID                    int          `json:"id"`                      // идентификатор сообщения
+			Date                  int          `json:"date"`                    // время отправки в Unixtime
+			FromID                int          `json:"from_id"`                 // идентификатор отправителя
+			Text                  string       `json:"text"`                    // текст сообщения
+			PeerID                int          `json:"peer_id"`                 // идентификатор диалога
+			ConversationMessageID int          `json:"conversation_message_id"` // номер сообщения в диалоге
+			Attachments           []attachment `json:"attachments"`             // вложения
 		} `json:"message"`
+		Attachments []attachment  `json:"attachments"`  // вложения записи
+		CopyHistory []copyHistory `json:"copy_history"` // Репост
 	} `json:"object"`
-	CopyHistory struct { // Репост
-		ID       int    `json:"id"`
-		Date     int    `json:"date"`
-		FromID   int    `json:"from_id"`
-		PostType string `json:"post_type"`
-		Text     string `json:"text"`
-	} `json:"copy_history"`
-	GroupID int `json:"group_id"`
+	GroupID int    `json:"group_id"`
+	EventID string `json:"event_id"` // уникальный идентификатор события
+	Secret  string `json:"secret"`   // секретный ключ из настроек Callback API
+}
+
+type copyHistory struct {
+	ID       int    `json:"id"`
+	OwnerID  int    `json:"owner_id"`
+	Date     int    `json:"date"`
+	FromID   int    `json:"from_id"`
+	PostType string `json:"post_type"`
+	Text     string `json:"text"`
+}
+
+// photoAuthor пользователь, загрузивший фото; для фото, добавленных от имени сообщества,
+// VK передает user_id 100, тогда автором считается владелец альбома
+func (e vkEvents) photoAuthor() int {
+	if e.Object.UserID == 0 || e.Object.UserID == 100 && e.Object.OwnerID < 0 {
+		return ownerOr(e.Object.OwnerID)
+	}
+	return e.Object.UserID
+}
+
+// repost возвращает исходную запись репоста или пустую структуру
+func (e vkEvents) repost() copyHistory {
+	if len(e.Object.CopyHistory) == 0 {
+		return copyHistory{}
+	}
+	return e.Object.CopyHistory[0]
 }
 
 type user struct {
@@ -80,318 +118,443 @@ type response struct {
 	Response int `json:"response"`
 }
 
-func handleLambdaEvent(event vkEvents) (string, error) {
+// handleLambda различает события Callback API и события EventBridge по расписанию
+func handleLambda(ctx context.Context, raw json.RawMessage) (string, error) {
+	return handleRaw(ctx, raw, true)
+}
+
+// handleCallback обрабатывает событие, пришедшее по HTTP: принимаются только события Callback API,
+// задачи по расписанию запускаются только событиями EventBridge через Lambda
+func handleCallback(ctx context.Context, raw json.RawMessage) (string, error) {
+	return handleRaw(ctx, raw, false)
+}
+
+func handleRaw(ctx context.Context, raw json.RawMessage, allowScheduled bool) (string, error) {
+	defer stats.Flush()
+	ctx, root := startSpan(ctx, "handleLambda")
+	defer func() {
+		root.Finish(nil)
+		flushTraces()
+	}()
+	log.Printf("debug: событие %s", raw)
+
+	var scheduled events.CloudWatchEvent
+	if err := json.Unmarshal(raw, &scheduled); err == nil && scheduled.Source != "" {
+		if !allowScheduled || scheduled.Source != "aws.events" {
+			log.Printf("error: событие %v отклонено: ожидается событие Callback API", scheduled.Source)
+			return "\"error\"", errors.New("ожидается событие Callback API")
+		}
+		var result string
+		err := traced(ctx, "scheduled", func(ctx context.Context) (err error) {
+			result, err = handleScheduled(ctx, scheduled)
+			return err
+		})
+		return result, err
+	}
+
+	var event vkEvents
+	err := traced(ctx, "decode", func(ctx context.Context) error {
+		return json.Unmarshal(raw, &event)
+	})
+	if err != nil {
+		return "\"error\"", err
+	}
+	if event.Type == "" {
+		return "\"error\"", errors.New("в событии нет type")
+	}
+	root.Attrs["event_type"], root.Attrs["group_id"] = event.Type, event.GroupID
+	setLogFields(map[string]interface{}{"event_type": event.Type, "group_id": event.GroupID, "event_id": event.EventID})
+	defer setLogFields(nil)
+	start := time.Now()
+	defer func() {
+		logWith(levelInfo, "событие обработано", map[string]interface{}{"latency_ms": time.Since(start).Milliseconds()})
+	}()
+
+	if err := enterCommunity(event); err != nil {
+		log.Printf("error: %v", err)
+		return "\"error\"", err
+	}
+	// метрики пишутся только для проверенных событий, иначе любой запрос добавлял бы ряды
+	label := eventTypeLabel(event.Type)
+	stats.Inc(metricEvents, "event_type", label)
+	defer observeSince(metricEventDuration, start, "event_type", label)
+	storeEvent(event.Type, raw)
+
+	var result string
+	err = traced(ctx, "handle "+event.Type, func(ctx context.Context) (err error) {
+		result, err = handleLambdaEvent(ctx, event)
+		return err
+	}, "event_type", event.Type)
+	return result, err
+}
+
+// eventTypeLabel тип события для метрик; типы без обработчика объединяются в other
+func eventTypeLabel(eventType string) string {
+	if _, ok := eventHandlers[eventType]; ok {
+		return eventType
+	}
+	return "other"
+}
+
+func handleLambdaEvent(ctx context.Context, event vkEvents) (string, error) {
+	ctx = withUrgent(ctx, isUrgent(event))
+	checkErr(ctx, flushTyping(ctx, time.Now()), "flushTyping")
+	moderate(ctx, event)
+	recordActivity(ctx, event)
+	if bufferForDigest(event) {
+		return "ok", nil
+	}
 
-	log.Printf("EVENT: %v", event)
+	handler, ok := eventHandlers[event.Type]
+	if !ok {
+		message := "Произошло событие:" + event.Type
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
+		return "ok", nil
+	}
+	return handler(ctx, event)
+}
 
-	switch event.Type {
+// eventHandler обрабатывает событие одного типа и возвращает ответ для VK
+type eventHandler func(ctx context.Context, event vkEvents) (string, error)
 
+// eventHandlers обработчики событий по типам. По этой же таблице команда setup включает
+// события в настройках Callback API, а метрики отличают известные типы от прочих;
+// события без обработчика приходят уведомлением «Произошло событие».
+var eventHandlers = map[string]eventHandler{
 	// Тестовые и системные сообщения
-	case "confirmation":
-		return confirmationToken, nil
+	"confirmation": func(ctx context.Context, event vkEvents) (string, error) {
+		if confirmationToken != "" {
+			return confirmationToken, nil
+		}
+		// без CONFIRMATION_TOKEN код запрашивается у VK, так сервер подтверждается
+		// сразу после регистрации командой setup
+		params := url.Values{}
+		params.Set("group_id", vkGroupID)
+		var code struct {
+			Code string `json:"code"`
+		}
+		if err := callAPI(ctx, "groups.getCallbackConfirmationCode", params, &code); err != nil {
+			return "", err
+		}
+		return code.Code, nil
+	},
 
-	case "test_connection":
+	"test_connection": func(ctx context.Context, event vkEvents) (string, error) {
 		message := "проверка связи"
 
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 
 		return "ok", nil
+	},
 
-	case "message_reply":
-		// новое исходящее сообщение, возникает каждый раз при отправке сообщения и зацикливается, если по факту этого события происходит снова отправка сообщения
+	"message_reply": func(ctx context.Context, event vkEvents) (string, error) {
+		// новое исходящее сообщение, возникает каждый раз при отправке сообщения, в том числе
+		// уведомлений этой функции; отправка в ответ зациклилась бы, поэтому handleReply ее запрещает
+		handleReply(ctx, event)
 		return "ok", nil
+	},
 
-	case "message_typing_state":
-		// кто-то набирает сообщение, может быть очень много уведомлений
+	"message_typing_state": func(ctx context.Context, event vkEvents) (string, error) {
+		// кто-то набирает сообщение, может быть очень много событий; уведомления не отправляются,
+		// набор текста только откладывает уведомление о сообщениях (TYPING_WINDOW)
+		recordTyping(ctx, event)
 		return "ok", nil
+	},
 
 	// Раздел Сообщения
-	case "message_new":
+	"message_new": func(ctx context.Context, event vkEvents) (string, error) {
+		if reply, ok := runAdminCommand(ctx, event.Object.Message.FromID, event.Object.Message.Text); ok {
+			sendMessage(ctx, reply, strconv.Itoa(event.Object.Message.FromID))
+			return "ok", nil
+		}
+
+		priority := messagePriority(event.Object.Message.FromID, event.Object.Message.Text)
+		trackIncoming(ctx, event, priority)
+
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.Message.FromID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "входящее сообщение от " + lastName + " " + firstName + " https://vk.com/id" + userID + ": " + event.Object.Message.Text
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		header := "входящее сообщение от " + lastName + " " + firstName + " " + links.Owner(event.Object.Message.FromID)
+		text := event.Object.Message.Text + attachmentsText(event.Object.Message.Attachments)
+		if coalesceIncoming(ctx, event, header, text, priority == priorityHigh) {
+			// пользователь еще пишет или сообщение ушло вместе с отложенными: уведомление одно на все
+			return "ok", nil
+		}
+
+		message := header + ": " + text
+		if priority == priorityHigh {
+			message = "[высокий приоритет] " + message
+		}
+		n := notification{Text: message}
+		if event.Object.Message.ID != 0 {
+			n.Forward = []int{event.Object.Message.ID}
+		} else {
+			n.Attachments = attachmentRefs(event.Object.Message.Attachments)
+		}
+		var conversationIDs []int
+		if id := event.Object.Message.ConversationMessageID; id != 0 {
+			conversationIDs = []int{id}
+		}
+		deliverIncoming(ctx, event.Object.Message.PeerID, conversationIDs, header, n)
 		return "ok", nil
+	},
 
-	case "message_allow":
+	"message_allow": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
-		userID := strconv.Itoa(event.Object.Message.FromID)
-		firstName, lastName := getUserInfo(userID)
+		userID := strconv.Itoa(event.Object.UserID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "подписка на сообщения от сообщества:" + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "подписка на сообщения от сообщества:" + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.UserID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "message_deny":
+	"message_deny": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
-		userID := strconv.Itoa(event.Object.Message.FromID)
-		firstName, lastName := getUserInfo(userID)
+		userID := strconv.Itoa(event.Object.UserID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "новый запрет сообщений от сообщества:" + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "новый запрет сообщений от сообщества:" + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.UserID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Фотографии
-
-	case "photo_new":
+	// Раздел Фотографии
+	"photo_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
-		userID := strconv.Itoa(event.Object.Message.FromID)
-		photoID := strconv.Itoa(event.Object.ID)
-		firstName, lastName := getUserInfo(userID)
+		author := event.photoAuthor()
+		firstName, lastName := getUserInfo(ctx, strconv.Itoa(author))
 
-		message := "добавление фотографии в альбом" + vkPhotoAlbumID + strconv.Itoa(event.Object.AlbumID) + " от " + lastName + " " + firstName + " https://vk.com/id" + userID + " фото " + vkPhotoAlbumID + photoID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "добавление фотографии в альбом " + links.Album(ownerOr(event.Object.OwnerID), event.Object.AlbumID) + " от " + lastName + " " + firstName + " " + links.Owner(author) + " фото " + links.Photo(ownerOr(event.Object.OwnerID), event.Object.ID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "photo_comment_new":
+	"photo_comment_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
-		userID := strconv.Itoa(event.Object.Message.FromID)
-		photoID := strconv.Itoa(event.Object.PhotoID)
-		firstName, lastName := getUserInfo(userID)
+		userID := strconv.Itoa(event.Object.FromID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Добавлен комментарий под фото https://vk.com/" + vkPhotoAlbumID + photoID + " " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Добавлен комментарий под фото " + links.Photo(ownerOr(event.Object.PhotoOwner), event.Object.PhotoID) + excerpt(ctx, "photo", ownerOr(event.Object.PhotoOwner), event.Object.PhotoID) + " " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "photo_comment_edit":
+	"photo_comment_edit": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
-		userID := strconv.Itoa(event.Object.Message.FromID)
-		photoID := strconv.Itoa(event.Object.PhotoID)
-		firstName, lastName := getUserInfo(userID)
+		userID := strconv.Itoa(event.Object.FromID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Отредактирован комментарий под фото https://vk.com/" + vkPhotoAlbumID + photoID + " " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Отредактирован комментарий под фото " + links.Photo(ownerOr(event.Object.PhotoOwner), event.Object.PhotoID) + " " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "photo_comment_delete":
+	"photo_comment_delete": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
-		userID := strconv.Itoa(event.Object.FromID)
-		photoID := strconv.Itoa(event.Object.PhotoID)
-		firstName, lastName := getUserInfo(userID)
+		userID := strconv.Itoa(event.Object.UserID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Удален комментарий под фото https://vk.com/" + vkPhotoAlbumID + photoID + " " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Удален комментарий под фото " + links.Photo(ownerOr(event.Object.PhotoOwner), event.Object.PhotoID) + " " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.UserID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Аудиозаписи
-	case "audio_new":
+	// Раздел Аудиозаписи
+	"audio_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.OwnerID)
 		title := event.Object.Title
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Добавлена аудиозапись " + title + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Добавлена аудиозапись " + title + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.OwnerID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Видеозаписи
-	case "video_new":
+	// Раздел Видеозаписи
+	"video_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.OwnerID)
 		title := event.Object.Title
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Добавлена видеозапись " + title + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Добавлена видеозапись " + title + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.OwnerID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Записи на стене
-	case "wall_post_new":
+	// Раздел Записи на стене
+	"wall_post_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
-		userID := strconv.Itoa(event.Object.CopyHistory.FromID)
-		firstName, lastName := getUserInfo(userID)
-
-		message := "Добавлена запись на стене: " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		author := event.Object.FromID
+		if author == 0 {
+			author = ownerOr(event.Object.OwnerID)
+		}
+		firstName, lastName := getUserInfo(ctx, strconv.Itoa(author))
+
+		message := "Добавлена запись на стене: " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(author) +
+			attachmentsText(event.Object.Attachments)
+		n := notification{Text: message, Attachments: attachmentRefs(event.Object.Attachments)}
+		sendNotification(ctx, n, sendToUserID)
+		sendNotification(ctx, n, sendToUserIDControl)
+		crossPostTelegram(ctx, event)
 		return "ok", nil
+	},
 
-	case "wall_repost":
+	"wall_repost": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.FromID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 		var message string
-		switch event.Object.CopyHistory.PostType {
+		switch event.repost().PostType {
 		case "photo":
-			message = "Добавлен репост записи на стене к фото: " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID + " ссылка:https://vk.com/id" + string(event.Object.FromID) + "?z=photo-" + string(event.GroupID) + "_" + string(event.Object.CopyHistory.ID) + "%2Fwall" + string(event.Object.FromID) + "_" + string(event.Object.ID)
+			message = "Добавлен репост записи на стене к фото: " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID) + " ссылка: " + links.WallPost(ownerOr(event.Object.OwnerID), event.Object.ID)
 		default:
-			message = "Добавлен репост записи на стене: " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
+			message = "Добавлен репост записи на стене: " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID) + " ссылка: " + links.WallPost(ownerOr(event.Object.OwnerID), event.Object.ID)
 		}
 
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "wall_reply_new":
+	"wall_reply_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.FromID)
-		postID := strconv.Itoa(event.Object.PostID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := lastName + " " + firstName + " https://vk.com/id" + userID + " оставил(а) комментарий на стене: " + event.Object.Text + " ссылка на запись https://vk.com/" + vkWallID + postID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := lastName + " " + firstName + " " + links.Owner(event.Object.FromID) + " оставил(а) комментарий на стене: " + event.Object.Text + " ссылка на комментарий " + links.WallComment(ownerOr(event.Object.OwnerID), event.Object.PostID, event.Object.ID) +
+			" к записи" + excerpt(ctx, "post", ownerOr(event.Object.OwnerID), event.Object.PostID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Отметки "Мне нравится"
-	case "like_add":
+	// Раздел Отметки "Мне нравится"
+	"like_add": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.LikerID)
-		var object string
-		switch event.Object.ObjectType {
-		case "post":
-			object = "под записью " + vkWallID + strconv.Itoa(event.Object.ObjectID)
-		case "video":
-			object = "под видеозаписью " + vkVideoID + strconv.Itoa(event.Object.ObjectID)
-		case "photo":
-			object = "под фото " + vkPhotoID + strconv.Itoa(event.Object.ObjectID)
-		case "comment":
-			object = "под комментарием в записи " + vkWallID + strconv.Itoa(event.Object.ObjectID)
-		case "note":
-			object = "под заметкой " + strconv.Itoa(event.Object.ObjectID)
-		case "topic_comment":
-			object = "под комментарием в обсуждении " + strconv.Itoa(event.Object.ObjectID)
-		case "photo_comment":
-			object = "под комментарием к фото " + strconv.Itoa(event.Object.ObjectID)
-		case "video_comment":
-			object = "под комментарием к видео " + strconv.Itoa(event.Object.ObjectID)
-		case "market":
-			object = "под товаром " + strconv.Itoa(event.Object.ObjectID)
-		case "market_comment":
-			object = "под комментарием к товару " + strconv.Itoa(event.Object.ObjectID)
-		default:
-			object = "под " + event.Object.ObjectType + strconv.Itoa(event.Object.ObjectID)
-		}
+		object := likedObject(event) + likedExcerpt(ctx, event)
 
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := lastName + " " + firstName + " https://vk.com/id" + userID + " поставил(а) лайк " + object
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := lastName + " " + firstName + " " + links.Owner(event.Object.LikerID) + " поставил(а) лайк " + object
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "like_remove":
+	"like_remove": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.LikerID)
-		var object string
-		switch event.Object.ObjectType {
-		case "post":
-			object = "под записью " + vkWallID + strconv.Itoa(event.Object.ObjectID)
-		case "video":
-			object = "под видеозаписью " + strconv.Itoa(event.Object.ObjectID)
-		case "photo":
-			object = "под фото " + vkPhotoAlbumID + strconv.Itoa(event.Object.ObjectID)
-		case "comment":
-			object = "под комментарием " + strconv.Itoa(event.Object.ObjectID)
-		case "note":
-			object = "под заметкой " + strconv.Itoa(event.Object.ObjectID)
-		case "topic_comment":
-			object = "под комментарием в обсуждении " + strconv.Itoa(event.Object.ObjectID)
-		case "photo_comment":
-			object = "под комментарием к фото " + strconv.Itoa(event.Object.ObjectID)
-		case "video_comment":
-			object = "под комментарием к видео " + strconv.Itoa(event.Object.ObjectID)
-		case "market":
-			object = "под товаром " + strconv.Itoa(event.Object.ObjectID)
-		case "market_comment":
-			object = "под комментарием к товару " + strconv.Itoa(event.Object.ObjectID)
-		default:
-			object = "под " + event.Object.ObjectType + strconv.Itoa(event.Object.ObjectID)
-		}
+		object := likedObject(event) + likedExcerpt(ctx, event)
 
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := lastName + " " + firstName + " https://vk.com/id" + userID + " удалил(а) лайк " + object
+		message := lastName + " " + firstName + " " + links.Owner(event.Object.LikerID) + " удалил(а) лайк " + object
 
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Обсуждения
-	case "board_post_new":
+	// Раздел Обсуждения
+	"board_post_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.FromID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Создан комментарий в обсуждении: " + vkTopicID + strconv.Itoa(event.Object.TopicID) + " с текстом" + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Создан комментарий в обсуждении: " + links.TopicComment(ownerOr(event.Object.TopicOwner), event.Object.TopicID, event.Object.ID) + " с текстом" + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "board_post_edit":
+	"board_post_edit": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.FromID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Отредактирован комментарий в обсуждении: " + vkTopicID + strconv.Itoa(event.Object.TopicID) + " с текстом" + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Отредактирован комментарий в обсуждении: " + links.TopicComment(ownerOr(event.Object.TopicOwner), event.Object.TopicID, event.Object.ID) + " с текстом" + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "board_post_delete":
+	"board_post_delete": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 
-		message := "Удален комментарий в обсуждении: " + vkTopicID + strconv.Itoa(event.Object.TopicID)
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Удален комментарий в обсуждении: " + links.Topic(ownerOr(event.Object.TopicOwner), event.Object.TopicID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Товары
-	case "market_comment_new":
+	// Раздел Товары
+	"market_comment_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.FromID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Новый комментарий к товару: " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID + "идентификатор товара " + strconv.Itoa(event.Object.ItemID)
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Новый комментарий к товару: " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID) + " товар " + links.MarketItem(ownerOr(event.Object.MarketOwner), event.Object.ItemID) +
+			excerpt(ctx, "market", ownerOr(event.Object.MarketOwner), event.Object.ItemID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "market_comment_edit":
+	"market_comment_edit": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.FromID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "Редактирование комментария к товару: " + event.Object.Text + " от " + lastName + " " + firstName + " https://vk.com/id" + userID + "идентификатор товара " + strconv.Itoa(event.Object.ItemID)
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Редактирование комментария к товару: " + event.Object.Text + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.FromID) + " товар " + links.MarketItem(ownerOr(event.Object.MarketOwner), event.Object.ItemID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-	case "market_comment_delete":
+	"market_comment_delete": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 
-		message := "Удаление комментария к товару: " + "идентификатор товара " + strconv.Itoa(event.Object.ItemID)
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "Удаление комментария к товару: " + links.MarketItem(ownerOr(event.Object.MarketOwner), event.Object.ItemID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
+
+	// Раздел Пользователи
+	"group_leave": func(ctx context.Context, event vkEvents) (string, error) {
+		recordMembership(ctx, event)
 
-		// Раздел Пользователи
-	case "group_leave":
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.UserID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := lastName + " " + firstName + " https://vk.com/id" + userID + " покинул(а) группу"
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := lastName + " " + firstName + " " + links.Owner(event.Object.UserID) + " покинул(а) группу"
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
+
+	"group_join": func(ctx context.Context, event vkEvents) (string, error) {
+		recordMembership(ctx, event)
 
-	case "group_join":
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.UserID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 		joinType := event.Object.JoinType
 		var joinMessage string
 		switch joinType {
@@ -400,110 +563,273 @@ func handleLambdaEvent(event vkEvents) (string, error) {
 		case "request":
 			joinMessage = "подал приглашение"
 		}
-		message := lastName + " " + firstName + " https://vk.com/id" + userID + " вступил(а) в группу" + joinMessage
+		message := lastName + " " + firstName + " " + links.Owner(event.Object.UserID) + " вступил(а) в группу" + joinMessage
 
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
 
-		// Раздел Прочее
-	case "poll_vote_new":
+	// Раздел Прочее
+	"poll_vote_new": func(ctx context.Context, event vkEvents) (string, error) {
 		// message := event.Object.JoinType
 		userID := strconv.Itoa(event.Object.UserID)
-		firstName, lastName := getUserInfo(userID)
+		firstName, lastName := getUserInfo(ctx, userID)
 
-		message := "добавление голоса в публичном опросе: " + strconv.Itoa(event.Object.PollID) + " от " + lastName + " " + firstName + " https://vk.com/id" + userID + "идентификатор товара " + strconv.Itoa(event.Object.ItemID)
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
+		message := "добавление голоса в публичном опросе: " + links.Poll(ownerOr(event.Object.OwnerID), event.Object.PollID) + " от " + lastName + " " + firstName + " " + links.Owner(event.Object.UserID)
+		sendMessage(ctx, message, sendToUserID)
+		sendMessage(ctx, message, sendToUserIDControl)
 		return "ok", nil
+	},
+}
 
-	default:
-		message := "Произошло событие:" + event.Type
-		sendMessage(message, sendToUserID)
-		sendMessage(message, sendToUserIDControl)
-		return "ok", nil
+// likedObject описывает объект, под которым поставили или удалили лайк
+func likedObject(event vkEvents) string {
+	owner := ownerOr(event.Object.ObjectOwner)
+	id := strconv.Itoa(event.Object.ObjectID)
+	switch event.Object.ObjectType {
+	case "post":
+		return "под записью " + links.WallPost(owner, event.Object.ObjectID)
+	case "video":
+		return "под видеозаписью " + links.Video(owner, event.Object.ObjectID)
+	case "photo":
+		return "под фото " + links.Photo(owner, event.Object.ObjectID)
+	case "note":
+		return "под заметкой " + id
+	case "market":
+		return "под товаром " + links.MarketItem(owner, event.Object.ObjectID)
+	}
+	if c, ok := likedComments[event.Object.ObjectType]; ok {
+		// post_id — запись, фото, видео, обсуждение или товар, к которому оставлен комментарий
+		if event.Object.PostID == 0 {
+			return c.label + " " + id
+		}
+		return c.label + " " + c.link(owner, event.Object.PostID, event.Object.ObjectID)
+	}
+	return "под " + event.Object.ObjectType + " " + id
+}
+
+// likedComments комментарии, под которыми ставят лайки: описание и ссылка по объекту, к которому оставлен комментарий
+var likedComments = map[string]struct {
+	label string
+	link  func(ownerID, parentID, commentID int) string
+}{
+	"comment":        {"под комментарием", links.WallComment},
+	"topic_comment":  {"под комментарием в обсуждении", links.TopicComment},
+	"photo_comment":  {"под комментарием к фото", links.PhotoComment},
+	"video_comment":  {"под комментарием к видео", links.VideoComment},
+	"market_comment": {"под комментарием к товару", links.MarketComment},
+}
+
+// likedExcerpt возвращает фрагмент текста объекта, под которым поставили или удалили лайк
+func likedExcerpt(ctx context.Context, event vkEvents) string {
+	switch event.Object.ObjectType {
+	case "post", "photo", "video", "comment", "market":
+		return excerpt(ctx, event.Object.ObjectType, ownerOr(event.Object.ObjectOwner), event.Object.ObjectID)
+	}
+	return ""
+}
+
+// ownerOr возвращает владельца из события или, если он не указан, сообщество
+func ownerOr(ownerID int) int {
+	if ownerID != 0 {
+		return ownerID
 	}
+	return vkOwnerID
+}
 
-	// return "\"error\"", errorBackend
+// messageSink доставляет уведомления пользователю
+type messageSink interface {
+	Send(ctx context.Context, message, userID string) error
 }
 
-// sendMessage отправляет сообщение пользователю
-func sendMessage(message, userID string) {
+// notification уведомление с вложениями и пересылаемыми сообщениями
+type notification struct {
+	Text        string
+	Attachments []string // идентификаторы вида photo<owner>_<id>_<access_key>
+	Forward     []int    // идентификаторы пересылаемых сообщений
+}
 
-	log.Printf("Sending message: %v to user %v", message, userID)
+// richSink способ доставки, который умеет прикладывать вложения и пересылать сообщения
+type richSink interface {
+	SendNotification(ctx context.Context, n notification, userID string) error
+}
 
-	url := "https://api.vk.com/method/messages.send"
+// sink текущий способ доставки; при воспроизведении событий заменяется на печать
+var sink messageSink = vkSink{}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Fatal("error: ошибка при отправке сообщения в блоке http.NewRequest")
+// sendMessage отправляет сообщение пользователю; отложенное до конца тихих часов
+// и пропущенное сообщение ошибкой не считается
+func sendMessage(ctx context.Context, message, userID string) error {
+	if suppressed(ctx, userID) || deferQuiet(ctx, notification{Text: message}, userID) {
+		return nil
 	}
+	return traced(ctx, "deliver", func(ctx context.Context) error {
+		return sink.Send(ctx, applyTemplate(message), userID)
+	}, "sink", sinkName(), "peer_id", userID)
+}
 
-	q := req.URL.Query()
-	q.Add("message", message)
-	q.Add("user_id", userID)
-	q.Add("access_token", token)
-	q.Add("v", vkAPIversion)
-	q.Add("random_id", "0")
+// sendNotification отправляет уведомление с вложениями, если способ доставки это поддерживает,
+// иначе только текст
+func sendNotification(ctx context.Context, n notification, userID string) error {
+	if suppressed(ctx, userID) || deferQuiet(ctx, n, userID) {
+		return nil
+	}
+	n.Text = applyTemplate(n.Text)
+	return traced(ctx, "deliver", func(ctx context.Context) error {
+		if rich, ok := sink.(richSink); ok && forwardAttachments {
+			return rich.SendNotification(ctx, n, userID)
+		}
+		return sink.Send(ctx, n.Text, userID)
+	}, "sink", sinkName(), "peer_id", userID, "attachments", len(n.Attachments))
+}
 
-	req.URL.RawQuery = q.Encode()
+// sinkName название способа доставки для трасс
+func sinkName() string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", sink), "main.")
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal("error: ошибка при отправке сообщения в блоке client.Do")
+// vkSink отправляет сообщения через messages.send
+type vkSink struct{}
+
+func (s vkSink) Send(ctx context.Context, message, userID string) error {
+	return s.SendNotification(ctx, notification{Text: message}, userID)
+}
+
+func (vkSink) SendNotification(ctx context.Context, n notification, userID string) error {
+	message := n.Text
+
+	log.Printf("debug: отправка сообщения %v пользователю %v", message, userID)
+
+	params := url.Values{}
+	params.Set("message", message)
+	params.Set("peer_id", userID)
+	params.Set("random_id", newRandomID())
+	if len(n.Attachments) > 0 {
+		params.Set("attachment", strings.Join(n.Attachments, ","))
+	}
+	if len(n.Forward) > 0 {
+		var ids []string
+		for _, id := range n.Forward {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		params.Set("forward_messages", strings.Join(ids, ","))
 	}
 
-	echo, err := ioutil.ReadAll(resp.Body)
+	err := callAPI(ctx, "messages.send", params, nil)
 	if err != nil {
-		log.Fatal("error: ошибка при отправке сообщения в блоке ioutil.ReadAll")
+		log.Printf("error: сообщение пользователю %v не отправлено: %v", userID, err)
 	}
-	log.Printf("Ответ: %s\r\n", echo)
-	defer resp.Body.Close()
-
+	stats.Inc(metricDeliveries, "sink", "vk", "result", resultLabel(err))
+	return err
 }
 
 // getUserInfo получает информацию о пользователе
-func getUserInfo(userID string) (string, string) {
+func getUserInfo(ctx context.Context, userID string) (string, string) {
 
-	log.Printf("Check user: %v", userID)
+	log.Printf("debug: запрос пользователя %v", userID)
 
-	if userID == "0" {
+	if userID == "0" || strings.HasPrefix(userID, "-") {
+		// запись или фото от имени сообщества
 		return "группы", "Владелец"
 	}
 
-	vkURL := "https://api.vk.com/method/users.get?user_ids=" + userID + "&access_token=" + token + "&v=" + vkAPIversion
+	params := url.Values{}
+	params.Set("user_ids", userID)
 	user := new(user) // or &User{}
-	getJSON(vkURL, user)
+	if err := callAPI(ctx, "users.get", params, &user.Response); err != nil || len(user.Response) == 0 {
+		checkErr(ctx, err, "getUserInfo")
+		return "", ""
+	}
 	return user.Response[0].FirstName, user.Response[0].LastName
 
 	// slcB, _ := json.Marshal(event)
 	// fmt.Println(string(slcB))
 }
 
+// keepLines оставляет первые n строк текста
 func keepLines(s string, n int) string {
-	result := strings.Join(strings.Split(s, "\n")[:n], "\n")
+	lines := strings.Split(s, "\n")
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	result := strings.Join(lines, "\n")
 	return strings.Replace(result, "\r", "", -1)
 }
 
-func checkErr(err error, message string) {
+// envOr возвращает значение переменной окружения или значение по умолчанию
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt возвращает целочисленную переменную окружения или значение по умолчанию
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
 	if err != nil {
-		log.Print("error:" + message)
-		log.Print(err.Error())
-		message := "Возникла ОШИБКА в функции " + err.Error() + " " + message
-		sendMessage(message, sendToUserIDControl)
+		return def
+	}
+	return v
+}
+
+// envFloat возвращает дробную переменную окружения или значение по умолчанию
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
 	}
+	return v
+}
 
+// envDuration возвращает интервал из переменной окружения (например, 15m) или значение по умолчанию
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
 }
 
-func getJSON(url string, target interface{}) error {
-	r, err := myClient.Get(url)
-	checkErr(err, "getJSON")
-	defer r.Body.Close()
+// splitList разбивает список через запятую, пропуская пустые элементы
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func checkErr(ctx context.Context, err error, message string) {
+	if err != nil {
+		log.Printf("error: %v: %v", message, err)
+		message := "Возникла ОШИБКА в функции " + err.Error() + " " + message
+		sendMessage(ctx, message, sendToUserIDControl)
+	}
 
-	return json.NewDecoder(r.Body).Decode(target)
 }
 
 func main() {
-	lambda.Start(handleLambdaEvent)
+	log.SetFlags(0)
+	log.SetOutput(logger)
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	if err := initConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initEventStore(); err != nil {
+		log.Fatal(err)
+	}
+	var dirs []string
+	for _, c := range communities {
+		dirs = append(dirs, c.DataDir)
+	}
+	if err := checkDataDir(dirs); err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(handleLambda)
 }
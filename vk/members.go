@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Аналитика вступлений и выходов из сообщества
+var (
+	memberEvents          = newMemberStore(dataPath("members.jsonl"))
+	membersReportInterval = envDuration("MEMBERS_REPORT_INTERVAL", 24*time.Hour) // Как часто отправлять отчет по участникам
+	membersReportDays     = envInt("MEMBERS_REPORT_DAYS", 7)                     // За сколько дней строить отчет
+	membersChurnDays      = envInt("MEMBERS_CHURN_DAYS", 7)                      // Выход в течение стольких дней после вступления считается оттоком
+)
+
+// memberEvent вступление или выход участника
+type memberEvent struct {
+	Time     time.Time `json:"time"`
+	UserID   int       `json:"user_id"`
+	Type     string    `json:"type"`                // group_join или group_leave
+	JoinType string    `json:"join_type,omitempty"` // join, unsure, accepted, approved, request
+	Self     bool      `json:"self,omitempty"`      // участник вышел сам, а не был удален
+}
+
+// memberStore хранит события участников
+type memberStore interface {
+	Add(e memberEvent) error
+	// Since возвращает события начиная с from в порядке поступления
+	Since(from time.Time) ([]memberEvent, error)
+}
+
+// fileMemberStore хранит события участников в файле JSON lines
+type fileMemberStore struct {
+	file *jsonlFile
+}
+
+func newMemberStore(path string) memberStore {
+	return fileMemberStore{file: &jsonlFile{path: path}}
+}
+
+func (s fileMemberStore) Add(e memberEvent) error {
+	return s.file.Append(e)
+}
+
+func (s fileMemberStore) Since(from time.Time) ([]memberEvent, error) {
+	var list []memberEvent
+	err := s.file.ReadAll(func(line []byte) error {
+		var e memberEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		if !e.Time.Before(from) {
+			list = append(list, e)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// recordMembership сохраняет событие вступления или выхода
+func recordMembership(ctx context.Context, event vkEvents) {
+	e := memberEvent{
+		Time:     time.Now().UTC(),
+		UserID:   event.Object.UserID,
+		Type:     event.Type,
+		JoinType: event.Object.JoinType,
+		Self:     event.Object.Self == 1,
+	}
+	checkErr(ctx, memberEvents.Add(e), "recordMembership")
+}
+
+// sendMembersReport отправляет администраторам отчет по участникам по расписанию
+func sendMembersReport(ctx context.Context, now time.Time) error {
+	report, err := membersReport(ctx, now, membersReportDays)
+	if err != nil {
+		return err
+	}
+	sendMessage(ctx, report, sendToUserID)
+	sendMessage(ctx, report, sendToUserIDControl)
+	return nil
+}
+
+// membersReport собирает рост, отток и вернувшихся участников за days дней
+func membersReport(ctx context.Context, now time.Time, days int) (string, error) {
+	growth, err := growthReport(ctx, now, days)
+	if err != nil {
+		return "", err
+	}
+	churn, err := churnReport(ctx, now, days, membersChurnDays)
+	if err != nil {
+		return "", err
+	}
+	returning, err := returningReport(ctx, now, days)
+	if err != nil {
+		return "", err
+	}
+	return growth + "\n\n" + churn + "\n\n" + returning, nil
+}
+
+// growthReport считает вступления, выходы и чистый прирост по дням
+func growthReport(ctx context.Context, now time.Time, days int) (string, error) {
+	from := startOfDay(now).AddDate(0, 0, -days+1)
+	list, err := memberEvents.Since(from)
+	if err != nil {
+		return "", err
+	}
+
+	joins, leaves := map[string]int{}, map[string]int{}
+	for _, e := range list {
+		day := e.Time.In(now.Location()).Format("2006-01-02")
+		if e.Type == "group_join" {
+			joins[day]++
+		} else {
+			leaves[day]++
+		}
+	}
+
+	lines := []string{"Прирост участников за " + strconv.Itoa(days) + " дн.:"}
+	totalJoins, totalLeaves := 0, 0
+	for d := from; !d.After(now); d = d.AddDate(0, 0, 1) {
+		day := d.Format("2006-01-02")
+		lines = append(lines, day+": +"+strconv.Itoa(joins[day])+" −"+strconv.Itoa(leaves[day])+" = "+signed(joins[day]-leaves[day]))
+		totalJoins += joins[day]
+		totalLeaves += leaves[day]
+	}
+	lines = append(lines, "Итого: +"+strconv.Itoa(totalJoins)+" −"+strconv.Itoa(totalLeaves)+" = "+signed(totalJoins-totalLeaves))
+	return strings.Join(lines, "\n"), nil
+}
+
+// churnReport находит участников, вышедших в течение churnDays после вступления
+func churnReport(ctx context.Context, now time.Time, days, churnDays int) (string, error) {
+	from := startOfDay(now).AddDate(0, 0, -days+1)
+	list, err := memberEvents.Since(from)
+	if err != nil {
+		return "", err
+	}
+
+	joined := map[int]time.Time{}
+	joins := 0
+	var churned []int
+	for _, e := range list {
+		switch e.Type {
+		case "group_join":
+			joined[e.UserID] = e.Time
+			joins++
+		case "group_leave":
+			if t, ok := joined[e.UserID]; ok && e.Time.Sub(t) <= time.Duration(churnDays)*24*time.Hour {
+				churned = append(churned, e.UserID)
+			}
+			delete(joined, e.UserID)
+		}
+	}
+
+	line := "Ушли в течение " + strconv.Itoa(churnDays) + " дн. после вступления: " + strconv.Itoa(len(churned)) + " из " + strconv.Itoa(joins)
+	if joins > 0 {
+		line += " (" + strconv.Itoa(len(churned)*100/joins) + "%)"
+	}
+	if len(churned) > 0 {
+		line += "\n" + userNames(ctx, churned, digestNames)
+	}
+	return line, nil
+}
+
+// returningReport находит участников, которые вышли и вступили снова
+func returningReport(ctx context.Context, now time.Time, days int) (string, error) {
+	list, err := memberEvents.Since(time.Time{})
+	if err != nil {
+		return "", err
+	}
+
+	from := startOfDay(now).AddDate(0, 0, -days+1)
+	left := map[int]bool{}
+	var returned []int
+	for _, e := range list {
+		switch e.Type {
+		case "group_leave":
+			left[e.UserID] = true
+		case "group_join":
+			if left[e.UserID] && !e.Time.Before(from) && !containsInt(returned, e.UserID) {
+				returned = append(returned, e.UserID)
+			}
+			delete(left, e.UserID)
+		}
+	}
+
+	line := "Вернулись в сообщество за " + strconv.Itoa(days) + " дн.: " + strconv.Itoa(len(returned))
+	if len(returned) > 0 {
+		line += "\n" + userNames(ctx, returned, digestNames)
+	}
+	return line, nil
+}
+
+// leftAfterPostReport находит участников, вышедших в течение window после публикации записи
+func leftAfterPostReport(ctx context.Context, postID int, window time.Duration) (string, error) {
+	params := url.Values{}
+	// wall.getById недоступен с ключом сообщества
+	params.Set("access_token", adminToken)
+	params.Set("posts", strconv.Itoa(vkOwnerID)+"_"+strconv.Itoa(postID))
+
+	var posts []struct {
+		Date int64 `json:"date"`
+	}
+	if err := callAPI(ctx, "wall.getById", params, &posts); err != nil {
+		return "", err
+	}
+	if len(posts) == 0 {
+		return "", errors.New("запись " + strconv.Itoa(postID) + " не найдена")
+	}
+
+	published := time.Unix(posts[0].Date, 0)
+	list, err := memberEvents.Since(published)
+	if err != nil {
+		return "", err
+	}
+
+	var left []int
+	for _, e := range list {
+		if e.Type == "group_leave" && e.Time.Sub(published) <= window && !containsInt(left, e.UserID) {
+			left = append(left, e.UserID)
+		}
+	}
+
+	line := "Вышли в течение " + window.String() + " после записи " + links.WallPost(vkOwnerID, postID) + ": " + strconv.Itoa(len(left))
+	if len(left) > 0 {
+		line += "\n" + userNames(ctx, left, digestNames)
+	}
+	return line, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func signed(n int) string {
+	if n > 0 {
+		return "+" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChurnReport(t *testing.T) {
+	now := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	join := func(user int, ago time.Duration) memberEvent {
+		return memberEvent{Time: now.Add(-ago), UserID: user, Type: "group_join"}
+	}
+	leave := func(user int, ago time.Duration) memberEvent {
+		return memberEvent{Time: now.Add(-ago), UserID: user, Type: "group_leave", Self: true}
+	}
+
+	tests := []struct {
+		name   string
+		events []memberEvent
+		want   string // первая строка отчета
+		users  []string
+	}{
+		{
+			name: "никто не вступал",
+			want: "Ушли в течение 7 дн. после вступления: 0 из 0",
+		},
+		{
+			name:   "ушел через день",
+			events: []memberEvent{join(555, 10*day), leave(555, 9*day), join(777, 5*day)},
+			want:   "Ушли в течение 7 дн. после вступления: 1 из 2 (50%)",
+			users:  []string{"Фамилия555"},
+		},
+		{
+			name:   "ушел позже churnDays",
+			events: []memberEvent{join(555, 20*day), leave(555, 2*day)},
+			want:   "Ушли в течение 7 дн. после вступления: 0 из 1 (0%)",
+		},
+		{
+			name:   "вышел без вступления за период",
+			events: []memberEvent{leave(555, day)},
+			want:   "Ушли в течение 7 дн. после вступления: 0 из 0",
+		},
+		{
+			name:   "вступил снова после выхода",
+			events: []memberEvent{join(555, 10*day), leave(555, 9*day), join(555, 3*day)},
+			want:   "Ушли в течение 7 дн. после вступления: 1 из 2 (50%)",
+			users:  []string{"Фамилия555"},
+		},
+		{
+			name:   "события до начала периода не учитываются",
+			events: []memberEvent{join(555, 40*day), leave(555, 39*day)},
+			want:   "Ушли в течение 7 дн. после вступления: 0 из 0",
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		useTestSettings(t, &out)
+		for _, e := range tt.events {
+			if err := memberEvents.Add(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		report, err := churnReport(context.Background(), now, 30, 7)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		lines := strings.SplitN(report, "\n", 2)
+		if lines[0] != tt.want {
+			t.Errorf("%v: %q, ожидалось %q", tt.name, lines[0], tt.want)
+		}
+		for _, user := range tt.users {
+			if len(lines) < 2 || !strings.Contains(lines[1], user) {
+				t.Errorf("%v: в отчете нет %v:\n%s", tt.name, user, report)
+			}
+		}
+		if len(tt.users) == 0 && len(lines) > 1 {
+			t.Errorf("%v: лишние участники в отчете:\n%s", tt.name, report)
+		}
+	}
+}
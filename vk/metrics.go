@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Метрики событий, доставки уведомлений и вызовов VK API
+var (
+	metricsBackend   = os.Getenv("METRICS")                     // emf, prometheus или none; по умолчанию emf в Lambda
+	metricsNamespace = envOr("METRICS_NAMESPACE", "SMOHelpers") // Пространство имен метрик CloudWatch
+	stats            = newMetrics(metricsBackend)
+)
+
+// Имена метрик
+const (
+	metricEvents        = "vk_events_total"           // события Callback API по типам
+	metricEventDuration = "vk_event_duration_seconds" // время обработки события
+	metricDeliveries    = "vk_notifications_total"    // отправленные уведомления по способу доставки и результату
+	metricAPICalls      = "vk_api_requests_total"     // вызовы VK API по методам и результату
+	metricAPIDuration   = "vk_api_duration_seconds"   // время вызова VK API
+)
+
+// metricsRecorder получатель метрик; метки передаются парами ключ, значение
+type metricsRecorder interface {
+	Inc(name string, labels ...string)
+	Observe(name string, value float64, labels ...string)
+	// Flush отправляет накопленные метрики, например в конце обработки события
+	Flush()
+}
+
+func newMetrics(backend string) metricsRecorder {
+	if backend == "" && os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		backend = "emf"
+	}
+	switch backend {
+	case "emf":
+		return newEMFMetrics(os.Stdout, metricsNamespace)
+	case "prometheus":
+		return newPromMetrics()
+	default:
+		return noopMetrics{}
+	}
+}
+
+// observeSince записывает длительность с момента start в секундах
+func observeSince(name string, start time.Time, labels ...string) {
+	stats.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// resultLabel значение метки result для ошибки
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// noopMetrics ничего не записывает
+type noopMetrics struct{}
+
+func (noopMetrics) Inc(name string, labels ...string)                    {}
+func (noopMetrics) Observe(name string, value float64, labels ...string) {}
+func (noopMetrics) Flush()                                               {}
+
+// labelPair метка ряда
+type labelPair struct {
+	name, value string
+}
+
+// metricSeries ряд метрики: имя и метки, отсортированные по имени метки
+type metricSeries struct {
+	name   string
+	labels []labelPair
+}
+
+func newMetricSeries(name string, labels []string) metricSeries {
+	s := metricSeries{name: name}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.labels = append(s.labels, labelPair{labels[i], labels[i+1]})
+	}
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+	return s
+}
+
+// id однозначный ключ ряда; значения меток могут содержать любые символы, поэтому кодируются в JSON
+func (s metricSeries) id() string {
+	parts := []string{s.name}
+	for _, l := range s.labels {
+		parts = append(parts, l.name, l.value)
+	}
+	b, _ := json.Marshal(parts)
+	return string(b)
+}
+
+// labelMap метки ряда по именам
+func (s metricSeries) labelMap() map[string]string {
+	m := map[string]string{}
+	for _, l := range s.labels {
+		m[l.name] = l.value
+	}
+	return m
+}
+
+// seriesSet ряды метрик по ключу id
+type seriesSet map[string]metricSeries
+
+// add запоминает ряд и возвращает его ключ
+func (set seriesSet) add(name string, labels []string) string {
+	s := newMetricSeries(name, labels)
+	id := s.id()
+	if _, ok := set[id]; !ok {
+		set[id] = s
+	}
+	return id
+}
+
+// sorted ключи рядов из ids по имени метрики, затем по меткам
+func (set seriesSet) sorted(ids []string) []string {
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := set[ids[i]], set[ids[j]]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// emfMetrics пишет метрики в CloudWatch Embedded Metric Format: Lambda отправляет
+// строки из вывода в CloudWatch Logs, а CloudWatch извлекает из них метрики
+type emfMetrics struct {
+	out       io.Writer
+	namespace string
+
+	mu       sync.Mutex
+	series   seriesSet
+	counters map[string]float64
+	values   map[string][]float64
+}
+
+func newEMFMetrics(out io.Writer, namespace string) *emfMetrics {
+	return &emfMetrics{out: out, namespace: namespace, series: seriesSet{}, counters: map[string]float64{}, values: map[string][]float64{}}
+}
+
+func (m *emfMetrics) Inc(name string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[m.series.add(name, labels)]++
+}
+
+func (m *emfMetrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.series.add(name, labels)
+	m.values[id] = append(m.values[id], value)
+}
+
+func (m *emfMetrics) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, n := range m.counters {
+		m.write(m.series[id], "Count", n)
+	}
+	for id, list := range m.values {
+		m.write(m.series[id], "Seconds", list)
+	}
+	m.series = seriesSet{}
+	m.counters = map[string]float64{}
+	m.values = map[string][]float64{}
+}
+
+// write выводит одну запись EMF; значения гистограммы передаются массивом
+func (m *emfMetrics) write(series metricSeries, unit string, value interface{}) {
+	dimensions := []string{}
+	record := map[string]interface{}{}
+	for _, l := range series.labels {
+		dimensions = append(dimensions, l.name)
+		record[l.name] = l.value
+	}
+	record[series.name] = value
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []interface{}{map[string]interface{}{
+			"Namespace":  m.namespace,
+			"Dimensions": [][]string{dimensions},
+			"Metrics":    []interface{}{map[string]string{"Name": series.name, "Unit": unit}},
+		}},
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	m.out.Write(append(b, '\n'))
+}
+
+// promBuckets границы гистограмм длительности в секундах
+var promBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// promHistogram гистограмма в формате Prometheus
+type promHistogram struct {
+	buckets []uint64 // накопленные счетчики по promBuckets
+	count   uint64
+	sum     float64
+}
+
+// promMetrics хранит метрики в памяти и отдает их по /metrics в текстовом формате Prometheus
+type promMetrics struct {
+	mu         sync.Mutex
+	series     seriesSet
+	counters   map[string]float64
+	histograms map[string]*promHistogram
+}
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{series: seriesSet{}, counters: map[string]float64{}, histograms: map[string]*promHistogram{}}
+}
+
+func (m *promMetrics) Inc(name string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[m.series.add(name, labels)]++
+}
+
+func (m *promMetrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.series.add(name, labels)
+	h, ok := m.histograms[id]
+	if !ok {
+		h = &promHistogram{buckets: make([]uint64, len(promBuckets))}
+		m.histograms[id] = h
+	}
+	for i, le := range promBuckets {
+		if value <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Flush ничего не делает: Prometheus сам забирает метрики
+func (m *promMetrics) Flush() {}
+
+// ServeHTTP отдает метрики в текстовом формате Prometheus
+func (m *promMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b bytes.Buffer
+	typed := map[string]bool{}
+	var counterIDs []string
+	for id := range m.counters {
+		counterIDs = append(counterIDs, id)
+	}
+	for _, id := range m.series.sorted(counterIDs) {
+		series := m.series[id]
+		if !typed[series.name] {
+			fmt.Fprintf(&b, "# TYPE %v counter\n", series.name)
+			typed[series.name] = true
+		}
+		fmt.Fprintf(&b, "%v%v %v\n", series.name, promLabels(series, "", ""), m.counters[id])
+	}
+
+	var histogramIDs []string
+	for id := range m.histograms {
+		histogramIDs = append(histogramIDs, id)
+	}
+	for _, id := range m.series.sorted(histogramIDs) {
+		series, h := m.series[id], m.histograms[id]
+		if !typed[series.name] {
+			fmt.Fprintf(&b, "# TYPE %v histogram\n", series.name)
+			typed[series.name] = true
+		}
+		for i, le := range promBuckets {
+			fmt.Fprintf(&b, "%v_bucket%v %v\n", series.name, promLabels(series, "le", strconv.FormatFloat(le, 'g', -1, 64)), h.buckets[i])
+		}
+		fmt.Fprintf(&b, "%v_bucket%v %v\n", series.name, promLabels(series, "le", "+Inf"), h.count)
+		fmt.Fprintf(&b, "%v_sum%v %v\n", series.name, promLabels(series, "", ""), h.sum)
+		fmt.Fprintf(&b, "%v_count%v %v\n", series.name, promLabels(series, "", ""), h.count)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+// promLabels форматирует метки ряда {k="v",...}, добавляя extra, если он задан
+func promLabels(series metricSeries, extra, value string) string {
+	labels := series.labelMap()
+	if extra != "" {
+		labels[extra] = value
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	var names []string
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, k := range names {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
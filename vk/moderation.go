@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Модерация комментариев на стене, под фото, в обсуждениях и под товарами
+var (
+	moderationToken string // Ключ для удаления комментариев и блокировок (MODERATION_TOKEN, по умолчанию ADMIN_TOKEN)
+	moderationRules = loadModerationRules(os.Getenv("MODERATION_RULES"))
+	moderationAudit = newAuditLog(os.Getenv("MODERATION_AUDIT_FILE"))
+)
+
+// Действия модерации в порядке возрастания строгости
+const (
+	actionNotify = "notify" // уведомить администраторов
+	actionDelete = "delete" // удалить комментарий
+	actionBan    = "ban"    // удалить комментарий и заблокировать автора
+)
+
+var actionLevel = map[string]int{actionNotify: 1, actionDelete: 2, actionBan: 3}
+
+// moderatedComment комментарий, который проходит проверку
+type moderatedComment struct {
+	EventType string
+	ID        int // идентификатор комментария
+	FromID    int // автор комментария
+	OwnerID   int // владелец объекта, для сообщества отрицательный
+	ObjectID  int // идентификатор записи, фото, обсуждения или товара
+	Text      string
+}
+
+// moderationRule проверяет комментарий и возвращает причину срабатывания
+type moderationRule interface {
+	Check(ctx context.Context, c moderatedComment) (reason string, matched bool)
+}
+
+// classifier подключаемый классификатор текста (спам, токсичность)
+type classifier interface {
+	Classify(ctx context.Context, text string) (label string, score float64, err error)
+}
+
+// configuredRule правило вместе с назначенным ему действием
+type configuredRule struct {
+	name   string
+	rule   moderationRule
+	action string
+}
+
+// moderationHit сработавшее правило
+type moderationHit struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// auditEntry запись журнала модерации
+type auditEntry struct {
+	Time      time.Time       `json:"time"`
+	EventType string          `json:"event_type"`
+	CommentID int             `json:"comment_id"`
+	ObjectID  int             `json:"object_id"`
+	OwnerID   int             `json:"owner_id"`
+	FromID    int             `json:"from_id"`
+	Action    string          `json:"action"`
+	Hits      []moderationHit `json:"hits"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// auditLog журнал действий модерации
+type auditLog interface {
+	Record(e auditEntry) error
+}
+
+// newModeratedComment извлекает комментарий из события
+func newModeratedComment(event vkEvents) (moderatedComment, bool) {
+	c := moderatedComment{
+		EventType: event.Type,
+		ID:        event.Object.ID,
+		FromID:    event.Object.FromID,
+		Text:      event.Object.Text,
+	}
+	switch event.Type {
+	case "wall_reply_new":
+		c.OwnerID, c.ObjectID = event.Object.OwnerID, event.Object.PostID
+	case "photo_comment_new":
+		c.OwnerID, c.ObjectID = event.Object.PhotoOwner, event.Object.PhotoID
+	case "board_post_new":
+		c.OwnerID, c.ObjectID = event.Object.TopicOwner, event.Object.TopicID
+	case "market_comment_new":
+		c.OwnerID, c.ObjectID = event.Object.MarketOwner, event.Object.ItemID
+	default:
+		return c, false
+	}
+	return c, true
+}
+
+// link возвращает ссылку на комментарий или объект, к которому он оставлен
+func (c moderatedComment) link() string {
+	switch c.EventType {
+	case "wall_reply_new":
+		return links.WallComment(c.OwnerID, c.ObjectID, c.ID)
+	case "photo_comment_new":
+		return links.Photo(c.OwnerID, c.ObjectID)
+	case "board_post_new":
+		return links.TopicComment(c.OwnerID, c.ObjectID, c.ID)
+	default:
+		return links.MarketItem(c.OwnerID, c.ObjectID)
+	}
+}
+
+// moderate проверяет комментарий всеми правилами и выполняет самое строгое из назначенных действий
+func moderate(ctx context.Context, event vkEvents) {
+	if len(moderationRules) == 0 {
+		return
+	}
+	c, ok := newModeratedComment(event)
+	if !ok || c.FromID < 0 {
+		// комментарии от имени сообщества не проверяем
+		return
+	}
+
+	var hits []moderationHit
+	action := ""
+	for _, r := range moderationRules {
+		reason, matched := r.rule.Check(ctx, c)
+		if !matched {
+			continue
+		}
+		hits = append(hits, moderationHit{Rule: r.name, Reason: reason})
+		if actionLevel[r.action] > actionLevel[action] {
+			action = r.action
+		}
+	}
+	if len(hits) == 0 {
+		return
+	}
+
+	switch action {
+	case actionBan:
+		audit(c, actionDelete, hits, deleteComment(ctx, c))
+		audit(c, actionBan, hits, banAuthor(ctx, c, hits))
+	case actionDelete:
+		audit(c, actionDelete, hits, deleteComment(ctx, c))
+	}
+	audit(c, actionNotify, hits, notifyModeration(ctx, c, action, hits))
+}
+
+// audit записывает действие в журнал модерации
+func audit(c moderatedComment, action string, hits []moderationHit, err error) {
+	e := auditEntry{
+		Time:      time.Now().UTC(),
+		EventType: c.EventType,
+		CommentID: c.ID,
+		ObjectID:  c.ObjectID,
+		OwnerID:   c.OwnerID,
+		FromID:    c.FromID,
+		Action:    action,
+		Hits:      hits,
+	}
+	if err != nil {
+		e.Error = err.Error()
+		log.Printf("error: модерация, действие %v: %v", action, err)
+	}
+	if err := moderationAudit.Record(e); err != nil {
+		log.Printf("error: не удалось записать журнал модерации: %v", err)
+	}
+}
+
+// deleteComment удаляет комментарий методом, соответствующим типу события
+func deleteComment(ctx context.Context, c moderatedComment) error {
+	params := url.Values{}
+	params.Set("access_token", moderationToken)
+	params.Set("comment_id", strconv.Itoa(c.ID))
+
+	var method string
+	switch c.EventType {
+	case "wall_reply_new":
+		method = "wall.deleteComment"
+		params.Set("owner_id", strconv.Itoa(c.OwnerID))
+	case "photo_comment_new":
+		method = "photos.deleteComment"
+		params.Set("owner_id", strconv.Itoa(c.OwnerID))
+	case "board_post_new":
+		method = "board.deleteComment"
+		params.Set("group_id", strconv.Itoa(-c.OwnerID))
+		params.Set("topic_id", strconv.Itoa(c.ObjectID))
+	case "market_comment_new":
+		method = "market.deleteComment"
+		params.Set("owner_id", strconv.Itoa(c.OwnerID))
+	}
+	return callAPI(ctx, method, params, nil)
+}
+
+// banAuthor блокирует автора комментария в сообществе
+func banAuthor(ctx context.Context, c moderatedComment, hits []moderationHit) error {
+	params := url.Values{}
+	params.Set("access_token", moderationToken)
+	params.Set("group_id", vkGroupID)
+	params.Set("owner_id", strconv.Itoa(c.FromID))
+	params.Set("comment", "автоматическая модерация: "+hits[0].Reason)
+	params.Set("comment_visible", "1")
+	return callAPI(ctx, "groups.ban", params, nil)
+}
+
+// notifyModeration сообщает администраторам о сработавших правилах
+func notifyModeration(ctx context.Context, c moderatedComment, action string, hits []moderationHit) error {
+	var reasons []string
+	for _, h := range hits {
+		reasons = append(reasons, h.Rule+" ("+h.Reason+")")
+	}
+	message := "Модерация: комментарий " + c.link() + " от " + links.Owner(c.FromID) +
+		": " + c.Text + " сработали правила: " + strings.Join(reasons, ", ") + " действие: " + action
+	// сработавшие правила важны и ночью
+	ctx = withUrgent(ctx, true)
+	err := sendMessage(ctx, message, sendToUserID)
+	if errControl := sendMessage(ctx, message, sendToUserIDControl); err == nil {
+		err = errControl
+	}
+	return err
+}
+
+// loadModerationRules разбирает настройку вида "stopwords:delete,links:notify"
+func loadModerationRules(config string) []configuredRule {
+	var rules []configuredRule
+	for _, item := range splitList(config) {
+		parts := strings.SplitN(item, ":", 2)
+		name, action := parts[0], actionNotify
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+		if actionLevel[action] == 0 {
+			log.Printf("error: неизвестное действие модерации %q для правила %q", action, name)
+			continue
+		}
+
+		var rule moderationRule
+		switch name {
+		case "stopwords":
+			rule = newStopWordsRule(splitList(os.Getenv("MODERATION_STOPWORDS")))
+		case "links":
+			rule = regexpRule{re: linkRe, reason: "ссылка"}
+		case "phones":
+			rule = phoneRule{}
+		case "repeat":
+			rule = newRepeatRule(envInt("MODERATION_REPEAT_LIMIT", 3), envDuration("MODERATION_REPEAT_WINDOW", 10*time.Minute))
+		case "new_account":
+			rule = newAccountRule{minFriends: envInt("MODERATION_MIN_FRIENDS", 5)}
+		case "classifier":
+			classifierURL := os.Getenv("MODERATION_CLASSIFIER_URL")
+			if classifierURL == "" {
+				log.Printf("error: правило модерации %q не включено: не указан MODERATION_CLASSIFIER_URL", name)
+				continue
+			}
+			rule = classifierRule{
+				classifier: httpClassifier{url: classifierURL},
+				threshold:  envFloat("MODERATION_CLASSIFIER_THRESHOLD", 0.8),
+			}
+		default:
+			log.Printf("error: неизвестное правило модерации %q", name)
+			continue
+		}
+		rules = append(rules, configuredRule{name: name, rule: rule, action: action})
+	}
+	return rules
+}
+
+// stopWordsRule срабатывает на слова из списка
+type stopWordsRule struct {
+	words []string
+}
+
+func newStopWordsRule(words []string) stopWordsRule {
+	for i, w := range words {
+		words[i] = strings.ToLower(w)
+	}
+	return stopWordsRule{words: words}
+}
+
+func (r stopWordsRule) Check(ctx context.Context, c moderatedComment) (string, bool) {
+	text := strings.ToLower(c.Text)
+	for _, w := range r.words {
+		if w != "" && strings.Contains(text, w) {
+			return "стоп-слово " + w, true
+		}
+	}
+	return "", false
+}
+
+var (
+	linkRe  = regexp.MustCompile(`(?i)(https?://|www\.|vk\.cc/|t\.me/|\b[a-z0-9-]+\.(ru|com|net|org|info|biz|io|me|su|cc|ly|рф)\b)`)
+	phoneRe = regexp.MustCompile(`\+?\d[\d\s\-().]{8,16}\d`)
+)
+
+// regexpRule срабатывает на совпадение с регулярным выражением
+type regexpRule struct {
+	re     *regexp.Regexp
+	reason string
+}
+
+func (r regexpRule) Check(ctx context.Context, c moderatedComment) (string, bool) {
+	if m := r.re.FindString(c.Text); m != "" {
+		return r.reason + " " + m, true
+	}
+	return "", false
+}
+
+// phoneRule срабатывает на номера телефонов
+type phoneRule struct{}
+
+func (phoneRule) Check(ctx context.Context, c moderatedComment) (string, bool) {
+	for _, m := range phoneRe.FindAllString(c.Text, -1) {
+		digits := 0
+		for _, r := range m {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits >= 10 && digits <= 13 {
+			return "телефон " + m, true
+		}
+	}
+	return "", false
+}
+
+// repeatRule срабатывает, если одинаковый текст пришел limit раз за window.
+// Счетчики хранятся в памяти и сбрасываются при холодном старте.
+type repeatRule struct {
+	limit  int
+	window time.Duration
+	mu     *sync.Mutex
+	seen   map[string][]time.Time
+}
+
+func newRepeatRule(limit int, window time.Duration) repeatRule {
+	return repeatRule{limit: limit, window: window, mu: &sync.Mutex{}, seen: map[string][]time.Time{}}
+}
+
+func (r repeatRule) Check(ctx context.Context, c moderatedComment) (string, bool) {
+	key := strings.Join(strings.Fields(strings.ToLower(c.Text)), " ")
+	if key == "" {
+		return "", false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range r.seen[key] {
+		if now.Sub(t) < r.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	r.seen[key] = recent
+
+	if len(recent) >= r.limit {
+		return "текст повторяется " + strconv.Itoa(len(recent)) + " раз", true
+	}
+	return "", false
+}
+
+// newAccountRule срабатывает на аккаунты без фото и почти без друзей
+type newAccountRule struct {
+	minFriends int
+}
+
+func (r newAccountRule) Check(ctx context.Context, c moderatedComment) (string, bool) {
+	params := url.Values{}
+	params.Set("user_ids", strconv.Itoa(c.FromID))
+	params.Set("fields", "has_photo,counters")
+
+	var users []struct {
+		Deactivated string `json:"deactivated"`
+		HasPhoto    int    `json:"has_photo"`
+		Counters    struct {
+			Friends int `json:"friends"`
+		} `json:"counters"`
+	}
+	if err := callAPI(ctx, "users.get", params, &users); err != nil || len(users) == 0 {
+		checkErr(ctx, err, "newAccountRule")
+		return "", false
+	}
+
+	u := users[0]
+	if u.Deactivated != "" {
+		return "аккаунт " + u.Deactivated, true
+	}
+	if u.HasPhoto == 0 && u.Counters.Friends < r.minFriends {
+		return "нет фото и друзей: " + strconv.Itoa(u.Counters.Friends), true
+	}
+	return "", false
+}
+
+// classifierRule срабатывает, если классификатор отнес текст к нежелательным
+type classifierRule struct {
+	classifier classifier
+	threshold  float64
+}
+
+func (r classifierRule) Check(ctx context.Context, c moderatedComment) (string, bool) {
+	label, score, err := r.classifier.Classify(ctx, c.Text)
+	if err != nil {
+		checkErr(ctx, err, "classifierRule")
+		return "", false
+	}
+	if label != "" && label != "ok" && score >= r.threshold {
+		return label + " " + strconv.FormatFloat(score, 'f', 2, 64), true
+	}
+	return "", false
+}
+
+// httpClassifier отправляет текст во внешний сервис и ожидает ответ {"label": "...", "score": 0.9}
+type httpClassifier struct {
+	url string
+}
+
+func (h httpClassifier) Classify(ctx context.Context, text string) (string, float64, error) {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return "", 0, err
+	}
+	r, err := post(ctx, myClient, h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Body.Close()
+
+	var result struct {
+		Label string  `json:"label"`
+		Score float64 `json:"score"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&result)
+	return result.Label, result.Score, err
+}
+
+// logAudit пишет журнал модерации в CloudWatch
+type logAudit struct{}
+
+func (logAudit) Record(e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	log.Printf("MODERATION: %s", b)
+	return nil
+}
+
+// fileAudit дописывает журнал модерации в файл в формате JSON lines
+type fileAudit struct {
+	file *jsonlFile
+}
+
+func (f fileAudit) Record(e auditEntry) error {
+	return f.file.Append(e)
+}
+
+func newAuditLog(path string) auditLog {
+	if path == "" {
+		return logAudit{}
+	}
+	return fileAudit{file: &jsonlFile{path: path}}
+}
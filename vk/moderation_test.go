@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModerationRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    moderationRule
+		text    string
+		matched bool
+	}{
+		{"стоп-слово", newStopWordsRule([]string{"Казино"}), "Лучшее КАЗИНО тут", true},
+		{"нет стоп-слова", newStopWordsRule([]string{"казино"}), "Какие есть размеры?", false},
+		{"пустое стоп-слово", newStopWordsRule([]string{""}), "Какие есть размеры?", false},
+		{"ссылка", regexpRule{re: linkRe, reason: "ссылка"}, "пишите в t.me/shop", true},
+		{"домен", regexpRule{re: linkRe, reason: "ссылка"}, "смотрите example.com", true},
+		{"без ссылки", regexpRule{re: linkRe, reason: "ссылка"}, "Спасибо, все пришло", false},
+		{"телефон", phoneRule{}, "звоните +7 (999) 123-45-67", true},
+		{"короткий номер", phoneRule{}, "заказ 123-45-67", false},
+	}
+	for _, tt := range tests {
+		c := moderatedComment{EventType: "wall_reply_new", FromID: 555, Text: tt.text}
+		if _, matched := tt.rule.Check(context.Background(), c); matched != tt.matched {
+			t.Errorf("%v: %q сработало %v, ожидалось %v", tt.name, tt.text, matched, tt.matched)
+		}
+	}
+}
+
+func TestRepeatRule(t *testing.T) {
+	rule := newRepeatRule(3, time.Minute)
+	c := moderatedComment{FromID: 555, Text: "Подпишитесь  на  наш канал"}
+	for i, want := range []bool{false, false, true} {
+		if _, matched := rule.Check(context.Background(), c); matched != want {
+			t.Errorf("повтор %d: сработало %v, ожидалось %v", i+1, matched, want)
+		}
+	}
+	// пробелы и регистр не делают текст другим
+	c.Text = "подпишитесь на наш КАНАЛ"
+	if _, matched := rule.Check(context.Background(), c); !matched {
+		t.Error("повтор с другим регистром не засчитан")
+	}
+}
+
+func TestLoadModerationRules(t *testing.T) {
+	tests := []struct {
+		config string
+		want   []string // правила с действиями
+	}{
+		{"", nil},
+		{"stopwords:delete,links", []string{"stopwords:delete", "links:notify"}},
+		{"phones:ban,links:erase", []string{"phones:ban"}},
+		{"unknown:delete,phones", []string{"phones:notify"}},
+		// без MODERATION_CLASSIFIER_URL классификатор не включается
+		{"classifier:delete,phones", []string{"phones:notify"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range loadModerationRules(tt.config) {
+			got = append(got, r.name+":"+r.action)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: правила %v, ожидалось %v", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestModerate(t *testing.T) {
+	stopwords := configuredRule{name: "stopwords", rule: newStopWordsRule([]string{"казино"})}
+	links := configuredRule{name: "links", rule: regexpRule{re: linkRe, reason: "ссылка"}}
+	rules := func(actions ...string) []configuredRule {
+		list := []configuredRule{stopwords, links}
+		for i := range list {
+			list[i].action = actions[i]
+		}
+		return list
+	}
+
+	tests := []struct {
+		name    string
+		rules   []configuredRule
+		event   string
+		calls   []string // вызовы API
+		notices int      // уведомлений администраторам
+	}{
+		{
+			name:  "ничего не сработало",
+			rules: rules(actionBan, actionBan),
+			event: `{"type": "wall_reply_new", "object": {"id": 36, "from_id": 555, "owner_id": -1, "post_id": 35, "text": "Какие есть размеры?"}}`,
+		},
+		{
+			name:    "уведомление",
+			rules:   rules(actionDelete, actionNotify),
+			event:   `{"type": "wall_reply_new", "object": {"id": 36, "from_id": 555, "owner_id": -1, "post_id": 35, "text": "смотрите example.com"}}`,
+			notices: 2,
+		},
+		{
+			name:    "самое строгое из действий",
+			rules:   rules(actionDelete, actionBan),
+			event:   `{"type": "photo_comment_new", "object": {"id": 36, "from_id": 555, "photo_owner_id": -1, "photo_id": 7, "text": "казино на example.com"}}`,
+			calls:   []string{"photos.deleteComment", "groups.ban"},
+			notices: 2,
+		},
+		{
+			name:    "удаление в обсуждении",
+			rules:   rules(actionDelete, actionNotify),
+			event:   `{"type": "board_post_new", "object": {"id": 36, "from_id": 555, "topic_owner_id": -1, "topic_id": 2, "text": "казино"}}`,
+			calls:   []string{"board.deleteComment"},
+			notices: 2,
+		},
+		{
+			name:  "комментарий от имени сообщества",
+			rules: rules(actionBan, actionBan),
+			event: `{"type": "wall_reply_new", "object": {"id": 36, "from_id": -1, "owner_id": -1, "post_id": 35, "text": "казино"}}`,
+		},
+		{
+			name:  "не комментарий",
+			rules: rules(actionBan, actionBan),
+			event: `{"type": "wall_post_new", "object": {"id": 36, "from_id": 555, "owner_id": -1, "text": "казино"}}`,
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		srv := useTestSettings(t, &out)
+		moderationRules = tt.rules
+
+		moderate(context.Background(), testEvent(t, tt.event))
+
+		var calls []string
+		for _, call := range srv.Calls() {
+			calls = append(calls, call.Method)
+		}
+		if !reflect.DeepEqual(calls, tt.calls) {
+			t.Errorf("%v: вызовы %v, ожидалось %v", tt.name, calls, tt.calls)
+		}
+		if got := strings.Count(out.String(), "Модерация:"); got != tt.notices {
+			t.Errorf("%v: уведомлений %d, ожидалось %d:\n%s", tt.name, got, tt.notices, out.String())
+		}
+	}
+}
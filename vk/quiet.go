@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Тихие часы: в заданное время получателя несрочные уведомления откладываются
+// и приходят одной утренней сводкой
+var (
+	quietHours   = parseQuietHours(os.Getenv("QUIET_HOURS"))        // Расписания получателей: "100=Europe/Moscow 23:00-08:00; *=+05:00 22:00-07:00"
+	urgentEvents = splitList(envOr("URGENT_EVENTS", "message_new")) // Типы событий, уведомления о которых приходят и в тихие часы
+	vipUsers     = splitList(os.Getenv("VIP_USERS"))                // Участники, события от которых из VIP_EVENTS срочные
+	vipEvents    = splitList(envOr("VIP_EVENTS", "group_leave"))    // Типы событий, срочные для участников из VIP_USERS
+	quietBuffer  = newQuietStore(dataPath("quiet.jsonl"))           // Уведомления, отложенные до конца тихих часов
+	quietLimit   = envInt("QUIET_DIGEST_LENGTH", 4000)              // Длина одного сообщения утренней сводки
+)
+
+// deliveryKey ключ значений контекста, которые управляют доставкой уведомлений события:
+// значения не переходят от одного события к другому, даже если они обрабатываются одновременно
+type deliveryKey int
+
+const (
+	urgentKey    deliveryKey = iota // уведомления доставляются и в тихие часы
+	noSendingKey                    // отправка сообщений VK запрещена
+)
+
+// withUrgent возвращает контекст, в котором уведомления доставляются и в тихие часы, если urgent
+func withUrgent(ctx context.Context, urgent bool) context.Context {
+	return context.WithValue(ctx, urgentKey, urgent)
+}
+
+// urgentDelivery проверяет, что уведомления в контексте ctx срочные
+func urgentDelivery(ctx context.Context) bool {
+	urgent, _ := ctx.Value(urgentKey).(bool)
+	return urgent
+}
+
+// quietSchedule тихие часы одного получателя в его часовом поясе
+type quietSchedule struct {
+	location *time.Location
+	from, to int // минуты от начала суток; если from > to, интервал проходит через полночь
+}
+
+// quiet проверяет, приходится ли момент t на тихие часы
+func (s quietSchedule) quiet(t time.Time) bool {
+	local := t.In(s.location)
+	minute := local.Hour()*60 + local.Minute()
+	if s.from <= s.to {
+		return minute >= s.from && minute < s.to
+	}
+	return minute >= s.from || minute < s.to
+}
+
+// parseQuietHours разбирает расписания через точку с запятой: получатель=пояс ЧЧ:ММ-ЧЧ:ММ.
+// Пояс задается именем из базы часовых поясов или смещением (+03:00); * — расписание по умолчанию.
+func parseQuietHours(config string) map[string]quietSchedule {
+	schedules := map[string]quietSchedule{}
+	for _, item := range strings.Split(config, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		s, peer, err := parseQuietSchedule(item)
+		if err != nil {
+			log.Printf("error: QUIET_HOURS %q: %v", item, err)
+			continue
+		}
+		schedules[peer] = s
+	}
+	return schedules
+}
+
+func parseQuietSchedule(item string) (quietSchedule, string, error) {
+	var s quietSchedule
+	parts := strings.SplitN(item, "=", 2)
+	if len(parts) != 2 {
+		return s, "", fmt.Errorf("ожидается получатель=пояс ЧЧ:ММ-ЧЧ:ММ")
+	}
+	fields := strings.Fields(parts[1])
+	if len(fields) != 2 {
+		return s, "", fmt.Errorf("ожидается пояс и интервал ЧЧ:ММ-ЧЧ:ММ")
+	}
+	location, err := parseLocation(fields[0])
+	if err != nil {
+		return s, "", err
+	}
+	bounds := strings.SplitN(fields[1], "-", 2)
+	if len(bounds) != 2 {
+		return s, "", fmt.Errorf("интервал %q: ожидается ЧЧ:ММ-ЧЧ:ММ", fields[1])
+	}
+	from, err := parseClock(bounds[0])
+	if err != nil {
+		return s, "", err
+	}
+	to, err := parseClock(bounds[1])
+	if err != nil {
+		return s, "", err
+	}
+	return quietSchedule{location: location, from: from, to: to}, strings.TrimSpace(parts[0]), nil
+}
+
+// parseLocation возвращает часовой пояс по имени (Europe/Moscow) или смещению (+03:00, -05)
+func parseLocation(name string) (*time.Location, error) {
+	if name == "" || (name[0] != '+' && name[0] != '-') {
+		return time.LoadLocation(name)
+	}
+	parts := strings.SplitN(name[1:], ":", 2)
+	hours, err := strconv.Atoi(parts[0])
+	minutes := 0
+	if err == nil && len(parts) == 2 {
+		minutes, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || hours > 14 || minutes > 59 {
+		return nil, fmt.Errorf("неверное смещение часового пояса %q", name)
+	}
+	offset := hours*3600 + minutes*60
+	if name[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(name, offset), nil
+}
+
+// parseClock переводит ЧЧ:ММ в минуты от начала суток
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("время %q: ожидается ЧЧ:ММ", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// quietNow проверяет, действуют ли сейчас тихие часы получателя
+func quietNow(peerID string, now time.Time) bool {
+	s, ok := quietHours[peerID]
+	if !ok {
+		s, ok = quietHours["*"]
+	}
+	return ok && s.quiet(now)
+}
+
+// isUrgent определяет, нужно ли доставлять уведомления о событии в тихие часы
+func isUrgent(event vkEvents) bool {
+	if contains(urgentEvents, event.Type) {
+		return true
+	}
+	return contains(vipEvents, event.Type) && contains(vipUsers, strconv.Itoa(eventAuthor(event)))
+}
+
+// eventAuthor участник, который совершил действие
+func eventAuthor(event vkEvents) int {
+	switch event.Type {
+	case "message_new":
+		return event.Object.Message.FromID
+	case "like_add", "like_remove":
+		return event.Object.LikerID
+	case "group_join", "group_leave", "message_allow", "message_deny", "poll_vote_new":
+		return event.Object.UserID
+	default:
+		return event.Object.FromID
+	}
+}
+
+// quietItem уведомление, отложенное до конца тихих часов получателя
+type quietItem struct {
+	Time         time.Time    `json:"time"`
+	PeerID       string       `json:"peer_id"`
+	Notification notification `json:"notification"`
+}
+
+// quietStore хранит отложенные уведомления между вызовами функции
+type quietStore interface {
+	Add(item quietItem) error
+	// Take удаляет из хранилища и возвращает уведомления, для которых ready вернула true
+	Take(ready func(item quietItem) bool) ([]quietItem, error)
+}
+
+// fileQuietStore хранит уведомления в файле JSON lines
+type fileQuietStore struct {
+	file *jsonlFile
+}
+
+func newQuietStore(path string) quietStore {
+	return fileQuietStore{file: &jsonlFile{path: path}}
+}
+
+func (s fileQuietStore) Add(item quietItem) error {
+	return s.file.Append(item)
+}
+
+func (s fileQuietStore) Take(ready func(item quietItem) bool) ([]quietItem, error) {
+	var items []quietItem
+	err := s.file.Take(func(line []byte) (bool, error) {
+		var item quietItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return false, err
+		}
+		if !ready(item) {
+			return false, nil
+		}
+		items = append(items, item)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// deferQuiet откладывает несрочное уведомление, если у получателя тихие часы
+func deferQuiet(ctx context.Context, n notification, peerID string) bool {
+	if urgentDelivery(ctx) || !quietNow(peerID, time.Now()) {
+		return false
+	}
+	if err := quietBuffer.Add(quietItem{Time: time.Now().UTC(), PeerID: peerID, Notification: n}); err != nil {
+		// не теряем уведомление: пусть придет сразу
+		log.Printf("error: не удалось отложить уведомление на время тихих часов: %v", err)
+		return false
+	}
+	stats.Inc(metricDeliveries, "sink", "quiet", "result", "deferred")
+	return true
+}
+
+// flushQuiet задача по расписанию: отправляет отложенное получателям, у которых закончились тихие часы
+func flushQuiet(ctx context.Context, now time.Time) error {
+	// уведомления получателей, у которых тихие часы еще не закончились, остаются в хранилище
+	items, err := quietBuffer.Take(func(item quietItem) bool {
+		return !quietNow(item.PeerID, now)
+	})
+	if err != nil || len(items) == 0 {
+		return err
+	}
+
+	ready := map[string][]notification{}
+	var peers []string
+	for _, item := range items {
+		if _, ok := ready[item.PeerID]; !ok {
+			peers = append(peers, item.PeerID)
+		}
+		ready[item.PeerID] = append(ready[item.PeerID], item.Notification)
+	}
+
+	ctx = withUrgent(ctx, true)
+	for _, peer := range peers {
+		deliverQuietDigest(ctx, ready[peer], peer)
+	}
+	return nil
+}
+
+// deliverQuietDigest отправляет текстовые уведомления одной сводкой, а уведомления
+// с вложениями и пересылкой — по отдельности, как они пришли бы без тихих часов
+func deliverQuietDigest(ctx context.Context, list []notification, peer string) {
+	var lines, texts []string
+	var rich []notification
+	for _, n := range list {
+		if len(n.Attachments) > 0 || len(n.Forward) > 0 {
+			rich = append(rich, n)
+			continue
+		}
+		texts = append(texts, n.Text)
+	}
+	for i, text := range texts {
+		lines = append(lines, strconv.Itoa(i+1)+". "+text)
+	}
+
+	header := "Уведомления за время тихих часов (" + strconv.Itoa(len(list)) + "):"
+	for _, message := range joinLimited(header, lines, quietLimit) {
+		sendMessage(ctx, message, peer)
+	}
+	for _, n := range rich {
+		sendNotification(ctx, n, peer)
+	}
+}
+
+// joinLimited собирает строки в сообщения не длиннее limit символов, каждое начинается с header
+func joinLimited(header string, lines []string, limit int) []string {
+	var messages []string
+	current := header
+	for _, line := range lines {
+		line = trimText(line, limit-len([]rune(header))-2)
+		if len([]rune(current))+len([]rune(line))+1 > limit {
+			messages = append(messages, current)
+			current = header
+		}
+		current += "\n" + line
+	}
+	if current != header || len(messages) == 0 {
+		messages = append(messages, current)
+	}
+	return messages
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	tests := []struct {
+		config string
+		peers  map[string][2]int // получатель: начало и конец в минутах от начала суток
+	}{
+		{"", map[string][2]int{}},
+		{"100=Europe/Moscow 23:00-08:00", map[string][2]int{"100": {23 * 60, 8 * 60}}},
+		{"100=+03:00 23:30-07:15; *=-05 13:00-14:00", map[string][2]int{"100": {23*60 + 30, 7*60 + 15}, "*": {13 * 60, 14 * 60}}},
+		// неверные расписания пропускаются, остальные действуют
+		{"100=Europe/Moscow; 200=Mars/Base 22:00-07:00; 300=+25:00 22:00-07:00; 400=UTC 25:00-07:00; *=UTC 22:00-07:00", map[string][2]int{"*": {22 * 60, 7 * 60}}},
+	}
+	for _, tt := range tests {
+		got := parseQuietHours(tt.config)
+		if len(got) != len(tt.peers) {
+			t.Errorf("%q: расписаний %d, ожидалось %d", tt.config, len(got), len(tt.peers))
+			continue
+		}
+		for peer, want := range tt.peers {
+			if s, ok := got[peer]; !ok || s.from != want[0] || s.to != want[1] {
+				t.Errorf("%q: расписание %v: %+v, ожидалось %v", tt.config, peer, s, want)
+			}
+		}
+	}
+}
+
+func TestQuietNow(t *testing.T) {
+	prev := quietHours
+	defer func() { quietHours = prev }()
+	quietHours = parseQuietHours("100=+03:00 23:00-08:00; 200=UTC 12:00-13:00; *=UTC 01:00-02:00")
+
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return time.Date(2026, 1, 10, t.Hour(), t.Minute(), 0, 0, time.UTC)
+	}
+	tests := []struct {
+		peer  string
+		now   time.Time
+		quiet bool
+	}{
+		{"100", at("20:00"), true}, // 23:00 по +03:00
+		{"100", at("04:59"), true}, // 07:59
+		{"100", at("05:00"), false},
+		{"100", at("19:59"), false},
+		{"200", at("12:30"), true},
+		{"200", at("13:00"), false},
+		{"300", at("01:30"), true}, // расписание по умолчанию
+		{"300", at("12:30"), false},
+	}
+	for _, tt := range tests {
+		if got := quietNow(tt.peer, tt.now); got != tt.quiet {
+			t.Errorf("quietNow(%v, %v) = %v, ожидалось %v", tt.peer, tt.now.Format("15:04"), got, tt.quiet)
+		}
+	}
+
+	quietHours = parseQuietHours("100=UTC 23:00-08:00")
+	if quietNow("300", at("23:30")) {
+		t.Error("без расписания по умолчанию тихих часов у получателя нет")
+	}
+}
+
+func TestFlushQuiet(t *testing.T) {
+	var out bytes.Buffer
+	useTestSettings(t, &out)
+	always := quietSchedule{location: time.UTC, from: 0, to: 24 * 60}
+	quietHours = map[string]quietSchedule{"100": always, "200": always}
+	ctx := context.Background()
+
+	for _, peer := range []string{"100", "200"} {
+		sendMessage(ctx, "вступил в группу "+peer, peer)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("уведомления не отложены:\n%s", out.String())
+	}
+
+	// у 100 тихие часы закончились, у 200 — еще нет
+	quietHours = map[string]quietSchedule{"200": always}
+	if err := flushQuiet(ctx, time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); !strings.Contains(got, "→ 100:") || !strings.Contains(got, "вступил в группу 100") || strings.Contains(got, "→ 200:") {
+		t.Errorf("отправлено:\n%s", got)
+	}
+
+	// уведомление 200 осталось в хранилище и уходит, когда тихие часы заканчиваются
+	out.Reset()
+	quietHours = nil
+	if err := flushQuiet(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); !strings.Contains(got, "→ 200:") || strings.Contains(got, "→ 100:") {
+		t.Errorf("отправлено:\n%s", got)
+	}
+}
+
+func TestDeferQuietUrgent(t *testing.T) {
+	var out bytes.Buffer
+	useTestSettings(t, &out)
+	quietHours = map[string]quietSchedule{"*": {location: time.UTC, from: 0, to: 24 * 60}}
+
+	ctx := context.Background()
+	if !deferQuiet(ctx, notification{Text: "лайк"}, "100") {
+		t.Error("несрочное уведомление не отложено")
+	}
+	if deferQuiet(withUrgent(ctx, true), notification{Text: "сообщение"}, "100") {
+		t.Error("срочное уведомление отложено")
+	}
+}
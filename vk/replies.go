@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Исходящие сообщения сообщества (message_reply): VK присылает их и на сообщения,
+// которые отправляет сама функция, поэтому отправка в ответ на них зациклилась бы
+var (
+	replyRelayChat = os.Getenv("TELEGRAM_REPLIES_CHAT") // Чат Telegram, куда пересылаются ответы администраторов; пусто — не пересылать
+)
+
+// sentMessages файл с random_id сообщений, отправленных функцией, и временем отправки.
+// Файл общий для всех экземпляров: message_reply может прийти на другой экземпляр.
+var sentMessages = dataPath("sent.json")
+
+// sentMessageTTL сколько помнить random_id; message_reply приходит через секунды после отправки
+const sentMessageTTL = time.Hour
+
+var ownRandom = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// newRandomID возвращает случайный random_id для messages.send и запоминает его, чтобы узнать
+// свое сообщение в событии message_reply
+func newRandomID() string {
+	id := strconv.Itoa(int(ownRandom.Int31n(math.MaxInt32)) + 1)
+	now := time.Now()
+	sent := map[string]time.Time{}
+	err := updateJSON(sentMessages, &sent, func() (bool, error) {
+		for k, t := range sent {
+			if now.Sub(t) > sentMessageTTL {
+				delete(sent, k)
+			}
+		}
+		sent[id] = now
+		return true, nil
+	})
+	if err != nil {
+		// сообщение все равно отправляется; ответ на него обработается как ответ администратора без отправки сообщений
+		log.Printf("error: не удалось запомнить random_id %v: %v", id, err)
+	}
+	return id
+}
+
+// isOwnMessage проверяет, что исходящее сообщение отправила сама функция: random_id совпадает
+// с запомненным, а сообщение не написано администратором
+func isOwnMessage(event vkEvents) bool {
+	if event.Object.AdminAuthor != 0 || event.Object.RandomID == 0 {
+		return false
+	}
+	sent := map[string]time.Time{}
+	if err := loadJSON(sentMessages, &sent); err != nil {
+		log.Printf("error: не удалось прочитать %v: %v", sentMessages, err)
+		return false
+	}
+	_, ok := sent[strconv.Itoa(event.Object.RandomID)]
+	return ok
+}
+
+// withoutSending возвращает контекст, в котором любые попытки отправить сообщение пропускаются;
+// так обрабатывается исходящее сообщение
+func withoutSending(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noSendingKey, true)
+}
+
+// suppressed проверяет запрет отправки в ctx и записывает пропущенное сообщение в журнал
+func suppressed(ctx context.Context, peerID string) bool {
+	if blocked, _ := ctx.Value(noSendingKey).(bool); !blocked {
+		return false
+	}
+	log.Printf("warn: сообщение в %v не отправлено: обработка исходящего сообщения не должна вызывать отправку", peerID)
+	stats.Inc(metricDeliveries, "sink", sinkName(), "result", "suppressed")
+	return true
+}
+
+// replyAuthor администратор, ответивший от имени сообщества; 0, если ответ отправлен через API
+func replyAuthor(event vkEvents) int {
+	if event.Object.AdminAuthor != 0 {
+		return event.Object.AdminAuthor
+	}
+	if event.Object.FromID > 0 {
+		// в старых версиях API from_id — администратор
+		return event.Object.FromID
+	}
+	return 0
+}
+
+// handleReply обрабатывает исходящее сообщение: свои сообщения пропускает, ответы администраторов
+// записывает для аналитики и пересылает в Telegram, не отправляя сообщений VK
+func handleReply(ctx context.Context, event vkEvents) {
+	if isOwnMessage(event) {
+		log.Printf("debug: собственное сообщение в %v пропущено", event.Object.PeerID)
+		return
+	}
+	event.Object.AdminAuthor = replyAuthor(event)
+	ctx = withoutSending(ctx)
+	logWith(levelInfo, "ответ сообщества", map[string]interface{}{"peer_id": event.Object.PeerID, "admin_id": event.Object.AdminAuthor})
+	trackReply(ctx, event)
+	relayReply(ctx, event)
+}
+
+// relayReply пересылает ответ администратора пользователю в чат TELEGRAM_REPLIES_CHAT
+func relayReply(ctx context.Context, event vkEvents) {
+	if replyRelayChat == "" || telegramToken == "" || !isUserDialog(event.Object.PeerID) {
+		return
+	}
+	admin := "через API"
+	if id := event.Object.AdminAuthor; id > 0 {
+		firstName, lastName := getUserInfo(ctx, strconv.Itoa(id))
+		admin = lastName + " " + firstName + " " + links.User(id)
+	}
+	text := "Ответ " + admin + " пользователю " + links.Owner(event.Object.PeerID) + ": " + event.Object.Text +
+		" " + links.Dialog(-vkOwnerID, event.Object.PeerID)
+
+	params := url.Values{}
+	params.Set("chat_id", replyRelayChat)
+	params.Set("text", trimText(text, telegramTextLimit-1))
+	params.Set("disable_web_page_preview", "true")
+	if err := telegramCall(ctx, "sendMessage", params, nil); err != nil {
+		log.Printf("error: ответ не переслан в Telegram: %v", err)
+	}
+}
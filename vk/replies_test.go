@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestIsOwnMessage(t *testing.T) {
+	var out bytes.Buffer
+	useTestSettings(t, &out)
+	if err := saveJSON(sentMessages, map[string]time.Time{"42": time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		event string
+		own   bool
+	}{
+		{"отправлено функцией", `{"type": "message_reply", "object": {"peer_id": 555, "random_id": 42}}`, true},
+		{"другой random_id", `{"type": "message_reply", "object": {"peer_id": 555, "random_id": 43}}`, false},
+		{"без random_id", `{"type": "message_reply", "object": {"peer_id": 555, "random_id": 0}}`, false},
+		// администратор мог отправить сообщение с тем же random_id через API
+		{"ответ администратора", `{"type": "message_reply", "object": {"peer_id": 555, "random_id": 42, "admin_author_id": 7}}`, false},
+	}
+	for _, tt := range tests {
+		if got := isOwnMessage(testEvent(t, tt.event)); got != tt.own {
+			t.Errorf("%v: isOwnMessage = %v, ожидалось %v", tt.name, got, tt.own)
+		}
+	}
+}
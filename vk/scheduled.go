@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// scheduledTasks задачи, которые запускаются правилом EventBridge по расписанию.
+// В detail события можно указать {"task": "digest"}, чтобы запустить одну задачу;
+// без указания запускаются все задачи.
+var scheduledTasks = map[string]func(ctx context.Context, now time.Time) error{
+	"digest":            flushDigest,
+	"members":           every("members", membersReportInterval, sendMembersReport),
+	"leaderboard_week":  every("leaderboard_week", 7*24*time.Hour, weeklyLeaderboard),
+	"leaderboard_month": monthly("leaderboard_month", monthlyLeaderboard),
+	"calendar":          runCalendar,
+	"quiet":             flushQuiet,
+	"escalation":        escalateUnanswered,
+	"responses":         every("responses", responseReportTick, sendResponseReport),
+	"typing":            flushTyping,
+	"telegram":          syncTelegram,
+}
+
+// scheduleState файл с временем последнего запуска периодических задач
+var scheduleState = dataPath("schedule.json")
+
+// every запускает fn не чаще, чем раз в interval
+func every(name string, interval time.Duration, fn func(ctx context.Context, now time.Time) error) func(ctx context.Context, now time.Time) error {
+	return whenDue(name, func(last, now time.Time) bool {
+		return now.Sub(last) >= interval
+	}, fn)
+}
+
+// monthly запускает fn один раз в календарный месяц
+func monthly(name string, fn func(ctx context.Context, now time.Time) error) func(ctx context.Context, now time.Time) error {
+	return whenDue(name, func(last, now time.Time) bool {
+		return last.Year() != now.Year() || last.Month() != now.Month()
+	}, fn)
+}
+
+// whenDue запускает fn, если due разрешает запуск; время последнего запуска хранится в каталоге данных
+func whenDue(name string, due func(last, now time.Time) bool, fn func(ctx context.Context, now time.Time) error) func(ctx context.Context, now time.Time) error {
+	return func(ctx context.Context, now time.Time) error {
+		// задача выполняется под блокировкой, чтобы два экземпляра не запустили ее одновременно
+		lastRun := map[string]time.Time{}
+		return updateJSON(scheduleState, &lastRun, func() (bool, error) {
+			if !due(lastRun[name], now) {
+				return false, nil
+			}
+			if err := fn(ctx, now); err != nil {
+				return false, err
+			}
+			lastRun[name] = now
+			return true, nil
+		})
+	}
+}
+
+// handleScheduled обрабатывает событие EventBridge (CloudWatch Events) по расписанию
+func handleScheduled(ctx context.Context, event events.CloudWatchEvent) (string, error) {
+	var detail struct {
+		Task string `json:"task"`
+	}
+	if len(event.Detail) > 0 {
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return "", err
+		}
+	}
+
+	now := event.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	// отчеты и сводки по расписанию несрочные и в тихие часы откладываются
+	ctx = withUrgent(ctx, false)
+
+	// задачи выполняются для каждого сообщества со своими настройками и данными
+	for _, c := range communities {
+		useCommunity(c)
+		for name, task := range scheduledTasks {
+			if detail.Task != "" && detail.Task != name {
+				continue
+			}
+			log.Printf("Scheduled task: %v, group %v", name, c.GroupID)
+			if err := task(ctx, now); err != nil {
+				checkErr(ctx, err, "задача по расписанию "+name)
+			}
+		}
+	}
+	return "ok", nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serveMu настройки сообщества переключаются на время обработки события, поэтому
+// сервер обрабатывает события по одному, как экземпляр Lambda
+var serveMu sync.Mutex
+
+// runServe запускает HTTP-сервер для Callback API вместо Lambda: события принимаются
+// на /, метрики Prometheus отдаются на /metrics
+func runServe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", envOr("HTTP_ADDR", ":8080"), "адрес, на котором принимать запросы")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// адрес сервера открыт всем, поэтому события принимаются только с секретным ключом
+	for _, c := range communities {
+		if c.Secret == "" {
+			return errors.New("сообщество " + strconv.Itoa(c.GroupID) + ": для serve задайте секретный ключ SECRET или secret в COMMUNITIES")
+		}
+	}
+	if metricsBackend == "" {
+		stats = newPromMetrics()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveCallback)
+	if prom, ok := stats.(*promMetrics); ok {
+		mux.Handle("/metrics", prom)
+	}
+	if typingWindow > 0 {
+		go flushTypingEvery(ctx, typingWindow/2)
+	}
+	log.Printf("HTTP-сервер слушает %v", *addr)
+	return http.ListenAndServe(*addr, mux)
+}
+
+// flushTypingEvery отправляет объединенные уведомления о сообщениях по таймеру; в Lambda
+// это делает следующее событие или задача typing по расписанию
+func flushTypingEvery(ctx context.Context, interval time.Duration) {
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		serveMu.Lock()
+		for _, c := range communities {
+			useCommunity(c)
+			checkErr(ctx, flushTyping(ctx, now), "flushTyping")
+		}
+		flushTraces()
+		serveMu.Unlock()
+	}
+}
+
+// serveCallback обрабатывает событие Callback API, полученное по HTTP
+func serveCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "ожидается POST", http.StatusMethodNotAllowed)
+		return
+	}
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil || !json.Valid(raw) {
+		http.Error(w, "ожидается событие в JSON", http.StatusBadRequest)
+		return
+	}
+
+	serveMu.Lock()
+	ctx := contextFromTraceparent(r.Context(), r.Header.Get("traceparent"))
+	result, err := handleCallback(ctx, raw)
+	serveMu.Unlock()
+	if err != nil {
+		http.Error(w, strings.Trim(result, `"`), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(result))
+}
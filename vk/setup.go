@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// callbackEventTypes все типы событий, которые включаются методом groups.setCallbackSettings;
+// типы без обработчика выключаются, чтобы не получать лишних уведомлений «Произошло событие»
+var callbackEventTypes = []string{
+	"message_new", "message_reply", "message_edit", "message_allow", "message_deny",
+	"message_typing_state", "message_event",
+	"photo_new", "photo_comment_new", "photo_comment_edit", "photo_comment_delete", "photo_comment_restore",
+	"audio_new",
+	"video_new", "video_comment_new", "video_comment_edit", "video_comment_delete", "video_comment_restore",
+	"wall_post_new", "wall_repost",
+	"wall_reply_new", "wall_reply_edit", "wall_reply_delete", "wall_reply_restore",
+	"like_add", "like_remove",
+	"board_post_new", "board_post_edit", "board_post_delete", "board_post_restore",
+	"market_comment_new", "market_comment_edit", "market_comment_delete", "market_comment_restore",
+	"market_order_new", "market_order_edit",
+	"group_leave", "group_join", "user_block", "user_unblock",
+	"poll_vote_new",
+	"group_officers_edit", "group_change_settings", "group_change_photo",
+	"vkpay_transaction", "app_payload",
+}
+
+// subscribedEvents типы событий из eventHandlers, которые включаются в настройках Callback API.
+// message_typing_state приходит очень часто и нужен только для объединения сообщений,
+// поэтому включается вместе с TYPING_WINDOW.
+func subscribedEvents() []string {
+	var list []string
+	for _, t := range callbackEventTypes {
+		if _, ok := eventHandlers[t]; !ok {
+			continue
+		}
+		if t == "message_typing_state" && typingWindow <= 0 {
+			continue
+		}
+		list = append(list, t)
+	}
+	return list
+}
+
+// callbackSetup результат настройки сервера Callback API
+type callbackSetup struct {
+	ServerID int
+	URL      string
+	Code     string
+	Notice   string // что сделано с кодом подтверждения, если он не совпал с настройками
+}
+
+// runSetup регистрирует адрес обработчика как сервер Callback API в каждом сообществе
+// и включает ровно те события, для которых есть обработчики. Код подтверждения, который
+// отличается от CONFIRMATION_TOKEN, сохраняется в источник настроек или печатается.
+func runSetup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("setup", flag.ContinueOnError)
+	endpoint := fs.String("url", "", "адрес, по которому VK будет отправлять события")
+	title := fs.String("title", "smo-helpers", "название сервера в настройках сообщества")
+	group := fs.Int("group", 0, "настроить только сообщество с этим group_id")
+	fs.BoolVar(&dryRun, "dry-run", false, "показать изменения без вызова изменяющих методов")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *endpoint == "" {
+		return errors.New("укажите адрес обработчика флагом -url")
+	}
+
+	found := false
+	for _, c := range communities {
+		if *group != 0 && c.GroupID != *group {
+			continue
+		}
+		found = true
+		useCommunity(c)
+		result, err := setupCallbackServer(ctx, *endpoint, *title)
+		if err != nil {
+			return fmt.Errorf("сообщество %v: %v", c.GroupID, err)
+		}
+		fmt.Printf("%v: сервер %v, код подтверждения %v, включено событий: %d\n", c.GroupID, result.ServerID, result.Code, len(subscribedEvents()))
+		if result.Notice != "" {
+			fmt.Printf("%v: %v\n", c.GroupID, result.Notice)
+		}
+	}
+	if !found {
+		return errors.New("сообщество " + strconv.Itoa(*group) + " не найдено в настройках")
+	}
+	return nil
+}
+
+// storeConfirmationCode сохраняет новый код подтверждения основного сообщества в источник
+// настроек и возвращает, что сделано с кодом. Работающий обработчик прочитает код при
+// следующем запуске, а до этого без CONFIRMATION_TOKEN запрашивает код у VK сам.
+func storeConfirmationCode(ctx context.Context, code string) string {
+	manual := "укажите CONFIRMATION_TOKEN=" + code + " (confirmation_token в COMMUNITIES)"
+	if confirmationToken == "" {
+		manual = "обработчик запросит код подтверждения сам; чтобы не запрашивать его каждый раз, " + manual
+	}
+	if dryRun || !currentCommunity.primary {
+		return manual
+	}
+	where, err := saveConfigValue(ctx, "CONFIRMATION_TOKEN", code)
+	if err != nil {
+		log.Printf("error: код подтверждения не сохранен: %v", err)
+		return manual
+	}
+	if where == "" {
+		return manual
+	}
+	return "код подтверждения сохранен в " + where + ", работающие экземпляры прочитают его после перезапуска"
+}
+
+// setupCallbackServer настраивает сервер Callback API текущего сообщества
+func setupCallbackServer(ctx context.Context, endpoint, title string) (callbackSetup, error) {
+	result := callbackSetup{URL: endpoint}
+
+	// VK отправляет запрос подтверждения сразу после добавления или изменения сервера,
+	// поэтому код проверяется до регистрации
+	params := url.Values{}
+	params.Set("group_id", vkGroupID)
+	var code struct {
+		Code string `json:"code"`
+	}
+	if err := callAPI(ctx, "groups.getCallbackConfirmationCode", params, &code); err != nil {
+		return result, err
+	}
+	result.Code = code.Code
+	if confirmationToken != code.Code {
+		result.Notice = storeConfirmationCode(ctx, code.Code)
+	}
+
+	params = url.Values{}
+	params.Set("group_id", vkGroupID)
+	var servers struct {
+		Items []struct {
+			ID        int    `json:"id"`
+			Title     string `json:"title"`
+			URL       string `json:"url"`
+			SecretKey string `json:"secret_key"`
+		} `json:"items"`
+	}
+	if err := callAPI(ctx, "groups.getCallbackServers", params, &servers); err != nil {
+		return result, err
+	}
+
+	params = url.Values{}
+	params.Set("group_id", vkGroupID)
+	params.Set("url", endpoint)
+	params.Set("title", title)
+	if currentCommunity.Secret != "" {
+		params.Set("secret_key", currentCommunity.Secret)
+	}
+	for _, s := range servers.Items {
+		if strings.TrimSuffix(s.URL, "/") == strings.TrimSuffix(endpoint, "/") {
+			result.ServerID = s.ID
+			if s.Title != title || s.SecretKey != currentCommunity.Secret {
+				params.Set("server_id", strconv.Itoa(s.ID))
+				if err := callAPI(ctx, "groups.editCallbackServer", params, nil); err != nil {
+					return result, err
+				}
+			}
+			break
+		}
+	}
+	if result.ServerID == 0 {
+		var added struct {
+			ServerID int `json:"server_id"`
+		}
+		if err := callAPI(ctx, "groups.addCallbackServer", params, &added); err != nil {
+			return result, err
+		}
+		result.ServerID = added.ServerID
+	}
+
+	params = url.Values{}
+	params.Set("group_id", vkGroupID)
+	params.Set("server_id", strconv.Itoa(result.ServerID))
+	params.Set("api_version", vkAPIversion)
+	enabled := map[string]bool{}
+	for _, t := range subscribedEvents() {
+		enabled[t] = true
+	}
+	for _, t := range callbackEventTypes {
+		if enabled[t] {
+			params.Set(t, "1")
+		} else {
+			params.Set(t, "0")
+		}
+	}
+	return result, callAPI(ctx, "groups.setCallbackSettings", params, nil)
+}
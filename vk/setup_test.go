@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSetupCallbackServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string // CONFIRMATION_TOKEN обработчика
+		notice string // начало сообщения о коде подтверждения, пусто — код совпал
+	}{
+		{"код совпадает", "abc123", ""},
+		{"другой код", "old", "укажите CONFIRMATION_TOKEN=abc123"},
+		{"код не задан", "", "обработчик запросит код подтверждения сам"},
+	}
+	prevToken, prevCommunity := confirmationToken, currentCommunity
+	defer func() { confirmationToken, currentCommunity = prevToken, prevCommunity }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newUploadServer(t)
+			srv.Handle("groups.getCallbackConfirmationCode", map[string]string{"code": "abc123"})
+			srv.Handle("groups.getCallbackServers", map[string]interface{}{"count": 0, "items": []interface{}{}})
+			srv.Handle("groups.addCallbackServer", map[string]int{"server_id": 7})
+			srv.Handle("groups.setCallbackSettings", 1)
+			confirmationToken, currentCommunity = tt.token, community{GroupID: 1}
+
+			// сервер регистрируется за один запуск, даже если код подтверждения не совпал
+			result, err := setupCallbackServer(context.Background(), "https://example.com/vk", "smo-helpers")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ServerID != 7 || result.Code != "abc123" {
+				t.Errorf("сервер %v, код %q", result.ServerID, result.Code)
+			}
+			if !strings.HasPrefix(result.Notice, tt.notice) || (tt.notice == "") != (result.Notice == "") {
+				t.Errorf("сообщение о коде %q, ожидается %q", result.Notice, tt.notice)
+			}
+			calls := methods(srv)
+			if last := calls[len(calls)-1]; !strings.HasPrefix(last, "groups.setCallbackSettings") {
+				t.Errorf("последний вызов %v", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+//go:build simulate
+// +build simulate
+
+// Команды simulate и post для локальной отладки: simulate поднимает поддельный VK API
+// из vktest, поэтому обе команды собираются только с тегом simulate:
+//
+//	go build -tags simulate -o vk-dev .
+//	./vk-dev simulate -type message_new -fake
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/butuhanov/smo-helpers/vk/vktest"
+)
+
+func init() {
+	cliCommands["simulate"] = cliCommand{"обработать событие локально и показать уведомления вместо отправки", runSimulate, true}
+	cliCommands["post"] = cliCommand{"отправить событие экземпляру, запущенному командой serve", runPost, true}
+}
+
+// setFlags повторяемый флаг -set путь=значение
+type setFlags []string
+
+func (s *setFlags) String() string     { return strings.Join(*s, ",") }
+func (s *setFlags) Set(v string) error { *s = append(*s, v); return nil }
+
+// eventFlags флаги, которыми описывается событие для simulate и post
+type eventFlags struct {
+	file      *string
+	eventType *string
+	fixtures  *string
+	sets      setFlags
+}
+
+func addEventFlags(fs *flag.FlagSet) *eventFlags {
+	f := &eventFlags{
+		file:      fs.String("event", "", "файл с событием Callback API или - для stdin"),
+		eventType: fs.String("type", "", "тип события; без -event за основу берется пример из testdata/events/<тип>.json"),
+		fixtures:  fs.String("fixtures", filepath.Join("testdata", "events"), "каталог с примерами событий"),
+	}
+	fs.Var(&f.sets, "set", "изменить поле события, например -set object.text=привет -set object.from_id=555; можно повторять")
+	return f
+}
+
+// build собирает событие из файла или примера и применяет изменения из -set
+func (f *eventFlags) build() ([]byte, error) {
+	var raw []byte
+	var err error
+	switch {
+	case *f.file == "-":
+		raw, err = ioutil.ReadAll(os.Stdin)
+	case *f.file != "":
+		raw, err = ioutil.ReadFile(*f.file)
+	case *f.eventType != "":
+		raw, err = ioutil.ReadFile(filepath.Join(*f.fixtures, *f.eventType+".json"))
+		if os.IsNotExist(err) {
+			raw, err = []byte(`{"object":{}}`), nil
+		}
+	default:
+		return nil, errors.New("укажите событие флагом -event или -type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+	if *f.eventType != "" {
+		event["type"] = *f.eventType
+	}
+	for _, set := range f.sets {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("-set %q: ожидается путь=значение", set)
+		}
+		if err := setPath(event, strings.Split(parts[0], "."), parseSetValue(parts[1])); err != nil {
+			return nil, fmt.Errorf("-set %q: %v", set, err)
+		}
+	}
+	return json.Marshal(event)
+}
+
+// setPath записывает значение по пути вида object.message.text, создавая вложенные объекты
+func setPath(m map[string]interface{}, path []string, value interface{}) error {
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			if _, exists := m[key]; exists {
+				return errors.New(key + " не объект")
+			}
+			next = map[string]interface{}{}
+			m[key] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = value
+	return nil
+}
+
+// parseSetValue разбирает значение как JSON (числа, true, массивы), иначе оставляет строкой
+func parseSetValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err == nil {
+		return v
+	}
+	return s
+}
+
+// runSimulate пропускает событие через обработчики локально и печатает уведомления вместо отправки
+func runSimulate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	ef := addEventFlags(fs)
+	fake := fs.Bool("fake", len(communities) == 0, "отвечать на вызовы API из testdata/responses.json вместо api.vk.com")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	raw, err := ef.build()
+	if err != nil {
+		return err
+	}
+
+	if *fake {
+		srv := vktest.NewServer()
+		defer srv.Close()
+		responses, err := loadGoldenResponses(filepath.Join(filepath.Dir(*ef.fixtures), "responses.json"))
+		if err != nil {
+			return err
+		}
+		for method, response := range responses {
+			srv.Handle(method, response)
+		}
+		tmp, err := ioutil.TempDir("", "simulate")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		defer useGoldenSettings(srv.URL(), tmp)()
+	}
+	dryRun = true
+	sink = printSink{w: os.Stdout}
+
+	var event vkEvents
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return err
+	}
+	if !*fake {
+		if err := enterCommunity(event); err != nil {
+			return err
+		}
+	}
+	result, err := handleLambdaEvent(ctx, event)
+	fmt.Printf("= %v\n", result)
+	return err
+}
+
+// runPost отправляет событие работающему экземпляру в режиме serve, подставляя group_id и секретный ключ
+func runPost(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("post", flag.ContinueOnError)
+	ef := addEventFlags(fs)
+	target := fs.String("url", "http://localhost:8080/", "адрес экземпляра, запущенного командой serve")
+	groupID := fs.Int("group", 0, "group_id события; по умолчанию сообщество из настроек")
+	secret := fs.String("secret", "", "секретный ключ; по умолчанию из настроек сообщества")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	raw, err := ef.build()
+	if err != nil {
+		return err
+	}
+
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return err
+	}
+	if *groupID == 0 && len(communities) > 0 {
+		*groupID = communities[0].GroupID
+	}
+	if *groupID != 0 {
+		event["group_id"] = *groupID
+	}
+	if *secret == "" {
+		if c, ok := communityByID(*groupID); ok {
+			*secret = c.Secret
+		}
+	}
+	if *secret != "" {
+		event["secret"] = *secret
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	r, err := post(ctx, myClient, *target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	answer, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v %s\n", r.Status, answer)
+	if r.StatusCode != http.StatusOK {
+		return errors.New("экземпляр вернул " + strconv.Itoa(r.StatusCode))
+	}
+	return nil
+}
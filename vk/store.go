@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	dataDir       = envOr("DATA_DIR", "/tmp/smo-helpers")  // Каталог для данных, которые должны переживать перезапуск функции (смонтированный EFS)
+	dataDirShared = os.Getenv("DATA_DIR_SHARED") == "true" // DATA_DIR общий для всех экземпляров, хотя это не NFS (например, другая сетевая ФС)
+	dryRun        bool                                     // Режим проверки: данные только читаются, вызовы API, меняющие данные, не выполняются
+)
+
+// sharedStateFeatures включенные возможности, которые хранят состояние между событиями:
+// если у экземпляров Lambda свои файлы, оно расходится между ними и теряется при их остановке
+func sharedStateFeatures() []string {
+	var list []string
+	if len(digestEvents) > 0 {
+		list = append(list, "DIGEST_EVENTS")
+	}
+	if len(quietHours) > 0 {
+		list = append(list, "QUIET_HOURS")
+	}
+	if len(escalateTo) > 0 {
+		list = append(list, "ESCALATE_TO")
+	}
+	if typingWindow > 0 {
+		list = append(list, "TYPING_WINDOW")
+	}
+	return list
+}
+
+// checkDataDir проверяет, что каталог данных общий для всех экземпляров Lambda. Без общего
+// каталога работают только возможности без состояния между событиями: если включена
+// одна из sharedStateFeatures, запуск прерывается, иначе в журнал пишется предупреждение.
+func checkDataDir(dirs []string) error {
+	if dataDirShared {
+		return nil
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if isSharedFS(dir) {
+			continue
+		}
+		if features := sharedStateFeatures(); len(features) > 0 {
+			return errors.New("каталог данных " + dir + " не на общем хранилище, а " + strings.Join(features, ", ") +
+				" требуют общего: смонтируйте EFS и укажите его в DATA_DIR или data_dir сообщества (DATA_DIR_SHARED=true, если хранилище общее, но не NFS)")
+		}
+		log.Printf("warn: каталог данных %v не на общем хранилище: расписание, рейтинг и статистика ответов у каждого экземпляра свои", dir)
+	}
+	return nil
+}
+
+// withLock выполняет fn под блокировкой файла path.lock, общей для процессов и экземпляров функции
+func withLock(path string, fn func() error) error {
+	if dryRun {
+		// в режиме проверки файлы не создаются, а данные не меняются
+		return fn()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	// закрытие файла снимает блокировку
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// updateJSON читает JSON-файл в v, вызывает fn и сохраняет v, если fn вернула true;
+// другой экземпляр не может изменить файл между чтением и записью
+func updateJSON(path string, v interface{}, fn func() (bool, error)) error {
+	return withLock(path, func() error {
+		if err := loadJSON(path, v); err != nil {
+			return err
+		}
+		changed, err := fn()
+		if err != nil || !changed {
+			return err
+		}
+		return saveJSON(path, v)
+	})
+}
+
+// jsonlFile файл с записями в формате JSON lines
+type jsonlFile struct {
+	path string
+	mu   sync.Mutex
+}
+
+// dataPath возвращает путь к файлу в каталоге данных
+func dataPath(name string) string {
+	return filepath.Join(dataDir, name)
+}
+
+// Append дописывает запись в конец файла
+func (f *jsonlFile) Append(v interface{}) error {
+	if dryRun {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return withLock(f.path, func() error {
+		return appendLine(f.path, b)
+	})
+}
+
+func appendLine(path string, b []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadAll передает каждую запись файла в fn; отсутствующий файл считается пустым
+func (f *jsonlFile) ReadAll(fn func(line []byte) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return withLock(f.path, func() error {
+		return readJSONL(f.path, fn)
+	})
+}
+
+// Drain читает все записи и очищает файл
+func (f *jsonlFile) Drain(fn func(line []byte) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if dryRun {
+		return readJSONL(f.path, fn)
+	}
+
+	// блокировка не дает другому экземпляру прочитать те же записи или дописать запись,
+	// которая будет удалена вместе с файлом
+	return withLock(f.path, func() error {
+		draining := f.path + ".drain"
+		if err := os.Rename(f.path, draining); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := readJSONL(draining, fn); err != nil {
+			return err
+		}
+		if err := os.Remove(draining); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Take передает записи в fn и удаляет из файла те, для которых fn вернула true; остальные
+// записи сохраняются одной атомарной записью, поэтому при ошибке файл остается прежним
+func (f *jsonlFile) Take(fn func(line []byte) (bool, error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return withLock(f.path, func() error {
+		var rest []byte
+		taken := false
+		err := readJSONL(f.path, func(line []byte) error {
+			take, err := fn(line)
+			if err != nil {
+				return err
+			}
+			if take {
+				taken = true
+			} else {
+				rest = append(append(rest, line...), '\n')
+			}
+			return nil
+		})
+		if err != nil || !taken || dryRun {
+			return err
+		}
+		return writeFileAtomic(f.path, rest)
+	})
+}
+
+func readJSONL(path string, fn func(line []byte) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// loadJSON читает JSON-файл в v; отсутствующий файл оставляет v без изменений
+func loadJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON атомарно записывает v в JSON-файл
+func saveJSON(path string, v interface{}) error {
+	if dryRun {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic записывает b во временный файл и переименовывает его в path,
+// чтобы читатели не увидели файл записанным наполовину
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
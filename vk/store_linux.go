@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// nfsSuperMagic тип файловой системы NFS, через которую монтируется EFS
+const nfsSuperMagic = 0x6969
+
+// isSharedFS проверяет, что каталог находится на сетевой файловой системе
+func isSharedFS(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	return st.Type == nfsSuperMagic
+}
+
+// lockFile берет исключительную блокировку файла; блокировка flock на NFS 4
+// действует для всех экземпляров функции, смонтировавших тот же каталог
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// isSharedFS вне Linux общий каталог не определяется
+func isSharedFS(dir string) bool {
+	return false
+}
+
+// lockFile вне Linux блокировка не нужна: функция там запускается только локально
+func lockFile(file *os.File) error {
+	return nil
+}
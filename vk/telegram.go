@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/butuhanov/smo-helpers/vk/links"
+)
+
+// Кросспостинг записей сообщества в канал Telegram
+var (
+	telegramToken   = os.Getenv("TELEGRAM_TOKEN")                           // Токен бота, который публикует записи в канал
+	telegramChannel = os.Getenv("TELEGRAM_CHANNEL")                         // Канал: @username или числовой id; пусто — кросспостинг выключен
+	telegramAPIURL  = envOr("TELEGRAM_API_URL", "https://api.telegram.org") // Адрес Bot API
+	telegramPosts   = dataPath("telegram.json")                             // Соответствие записей VK сообщениям в канале
+	telegramSync    = envDuration("TELEGRAM_SYNC_PERIOD", 72*time.Hour)     // Сколько после публикации переносить в канал правки и удаление записи
+)
+
+// Ограничения Bot API на длину текста
+const (
+	telegramTextLimit    = 4096
+	telegramCaptionLimit = 1024
+	telegramMediaGroup   = 10 // фотографий в одном альбоме
+)
+
+// telegramPost сообщения канала, в которые попала запись VK
+type telegramPost struct {
+	MessageIDs []int `json:"message_ids"`
+	// Caption текст записи опубликован подписью к фото, а не отдельным сообщением
+	Caption bool      `json:"caption,omitempty"`
+	Hash    string    `json:"hash,omitempty"` // хэш опубликованного текста, по нему видно, что запись изменили
+	Time    time.Time `json:"time,omitempty"` // время публикации в канале
+}
+
+// telegramError ошибка, которую возвращает Bot API
+type telegramError struct {
+	Code        int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+func (e *telegramError) Error() string {
+	return "Telegram API error " + strconv.Itoa(e.Code) + ": " + e.Description
+}
+
+// telegramCall вызывает метод Bot API и декодирует поле result в target
+func telegramCall(ctx context.Context, method string, params url.Values, target interface{}) error {
+	if dryRun {
+		log.Printf("DRY RUN: telegram %v %v", method, params.Encode())
+		return nil
+	}
+
+	r, err := post(ctx, myClient, telegramAPIURL+"/bot"+telegramToken+"/"+method, formContentType, strings.NewReader(params.Encode()))
+	if err != nil {
+		// в тексте ошибки адрес с токеном бота
+		return errors.New("telegram " + method + ": запрос не выполнен")
+	}
+	defer r.Body.Close()
+
+	var body struct {
+		OK     bool            `json:"ok"`
+		Result json.RawMessage `json:"result"`
+		telegramError
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return err
+	}
+	if !body.OK {
+		return &body.telegramError
+	}
+	if target == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Result, target)
+}
+
+// crossPostTelegram публикует новую запись сообщества в канал Telegram
+func crossPostTelegram(ctx context.Context, event vkEvents) {
+	if telegramChannel == "" || telegramToken == "" {
+		return
+	}
+	// отложенные и предложенные записи публикуем, когда они выйдут
+	if event.Object.PostType != "" && event.Object.PostType != "post" {
+		return
+	}
+	if event.Object.FromID != vkOwnerID {
+		// записи участников на стене сообщества не переносим
+		return
+	}
+
+	post, err := sendTelegramPost(ctx, event.Object.Text, event.Object.Attachments)
+	if err != nil {
+		log.Printf("error: не удалось опубликовать запись %v в Telegram: %v", event.Object.ID, err)
+		if len(post.MessageIDs) == 0 {
+			return
+		}
+		// часть сообщений уже в канале: запоминаем их, чтобы правка и удаление записи дошли и до них
+	}
+	body, _, _ := telegramContent(event.Object.Text, event.Object.Attachments, 0)
+	post.Hash, post.Time = contentHash(body), time.Now().UTC()
+	posts := map[string]telegramPost{}
+	checkErr(ctx, updateJSON(telegramPosts, &posts, func() (bool, error) {
+		posts[telegramKey(ownerOr(event.Object.OwnerID), event.Object.ID)] = post
+		return true, nil
+	}), "crossPostTelegram")
+}
+
+// sendTelegramPost отправляет запись в канал: фото альбомом с подписью, остальное текстом с превью ссылки.
+// Если отправлена только часть сообщений, возвращает их вместе с ошибкой.
+func sendTelegramPost(ctx context.Context, text string, attachments []attachment) (telegramPost, error) {
+	full, photos, _ := telegramContent(text, attachments, 0)
+
+	var post telegramPost
+	// подпись к фото короче сообщения; длинный текст отправляем отдельно перед фото
+	if caption, _, _ := telegramContent(text, attachments, telegramCaptionLimit); len(photos) > 0 && caption == full {
+		ids, err := sendTelegramPhotos(ctx, photos, caption)
+		post.MessageIDs, post.Caption = ids, true
+		return post, err
+	}
+
+	body, _, preview := telegramContent(text, attachments, telegramTextLimit)
+	if body != "" {
+		id, err := sendTelegramText(ctx, body, preview)
+		if err != nil {
+			return post, err
+		}
+		post.MessageIDs = append(post.MessageIDs, id)
+	}
+	if len(photos) > 0 {
+		ids, err := sendTelegramPhotos(ctx, photos, "")
+		post.MessageIDs = append(post.MessageIDs, ids...)
+		return post, err
+	}
+	return post, nil
+}
+
+// telegramContent переводит запись в HTML для Telegram и выделяет фотографии и ссылку для превью.
+// Видимый текст сокращается до limit символов (0 — без ограничения), ссылки на вложения сохраняются.
+func telegramContent(text string, attachments []attachment, limit int) (body string, photos []string, preview string) {
+	var extra []string
+	extraLength := 0
+	link := func(href, title string) {
+		extra = append(extra, telegramLink(href, title))
+		if title == "" {
+			title = href
+		}
+		// ссылки отделяются от текста пустой строкой, друг от друга — переводом строки
+		extraLength += len([]rune(title)) + 1
+	}
+	for _, a := range attachments {
+		switch {
+		case a.Photo != nil:
+			if u := a.Photo.largestURL(); u != "" {
+				photos = append(photos, u)
+			}
+		case a.Link != nil:
+			if preview == "" {
+				preview = a.Link.URL
+			}
+			if !strings.Contains(text, a.Link.URL) {
+				link(a.Link.URL, a.Link.Title)
+			}
+		case a.Video != nil:
+			link(links.Video(a.Video.OwnerID, a.Video.ID), "Видео: "+a.Video.Title)
+		case a.Doc != nil:
+			link(a.Doc.URL, "Документ: "+a.Doc.Title)
+		case a.Poll != nil:
+			link(links.Poll(a.Poll.OwnerID, a.Poll.ID), "Опрос: "+a.Poll.Question)
+		}
+	}
+
+	textLimit := limit
+	if limit > 0 && len(extra) > 0 {
+		textLimit = limit - extraLength - 1
+		if textLimit < 1 {
+			textLimit = 1
+		}
+	}
+	body = telegramHTML(text, textLimit)
+	if len(extra) > 0 {
+		body = strings.TrimSpace(body + "\n\n" + strings.Join(extra, "\n"))
+	}
+	return body, photos, preview
+}
+
+// vkMentionRe упоминания [id1|Имя], [club1|Название] и ссылки [https://...|текст]
+var vkMentionRe = regexp.MustCompile(`\[((?:id|club|public|event)\d+|https?://[^|\]]+)\|([^\]]+)\]`)
+
+// vkHashtagRe хэштеги сообщества вида #тема@группа
+var vkHashtagRe = regexp.MustCompile(`(#[\p{L}\p{N}_]+)@[\w.]+`)
+
+// telegramHTML переводит разметку VK в HTML, который понимает Telegram. Telegram ограничивает
+// длину видимого текста, а не разметки, поэтому текст сокращается до limit символов
+// (0 — без ограничения) до перевода в HTML: теги и сущности не обрезаются.
+func telegramHTML(text string, limit int) string {
+	text = strings.TrimSpace(vkHashtagRe.ReplaceAllString(text, "$1"))
+
+	// left сколько еще видимых символов помещается, -1 — текст помещается целиком
+	left := -1
+	if visible := []rune(vkMentionRe.ReplaceAllString(text, "$2")); limit > 0 && len(visible) > limit {
+		left = limit - 1 // место для многоточия
+	}
+	take := func(s string) string {
+		if left < 0 {
+			return s
+		}
+		runes := []rune(s)
+		if len(runes) > left {
+			runes = runes[:left]
+		}
+		left -= len(runes)
+		return string(runes)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range vkMentionRe.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(html.EscapeString(take(text[last:m[0]])))
+		last = m[1]
+		if left == 0 {
+			break
+		}
+		target, title := text[m[2]:m[3]], text[m[4]:m[5]]
+		if !strings.HasPrefix(target, "http") {
+			target = "https://vk.com/" + target
+		}
+		b.WriteString(telegramLink(target, take(title)))
+	}
+	if left != 0 {
+		b.WriteString(html.EscapeString(take(text[last:])))
+	}
+	if left >= 0 {
+		return strings.TrimSpace(b.String()) + "…"
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func telegramLink(href, title string) string {
+	if title == "" {
+		title = href
+	}
+	return `<a href="` + html.EscapeString(href) + `">` + html.EscapeString(title) + `</a>`
+}
+
+// sendTelegramText отправляет текстовое сообщение, уже сокращенное telegramContent;
+// preview — ссылка, для которой показывается превью
+func sendTelegramText(ctx context.Context, text, preview string) (int, error) {
+	params := url.Values{}
+	params.Set("chat_id", telegramChannel)
+	params.Set("text", text)
+	params.Set("parse_mode", "HTML")
+	if preview == "" {
+		params.Set("disable_web_page_preview", "true")
+	}
+
+	var message struct {
+		MessageID int `json:"message_id"`
+	}
+	err := telegramCall(ctx, "sendMessage", params, &message)
+	return message.MessageID, err
+}
+
+// sendTelegramPhotos отправляет фото одним сообщением или альбомами по 10; подпись ставится к первому фото
+func sendTelegramPhotos(ctx context.Context, photos []string, caption string) ([]int, error) {
+	if len(photos) == 1 {
+		params := url.Values{}
+		params.Set("chat_id", telegramChannel)
+		params.Set("photo", photos[0])
+		if caption != "" {
+			params.Set("caption", caption)
+			params.Set("parse_mode", "HTML")
+		}
+		var message struct {
+			MessageID int `json:"message_id"`
+		}
+		if err := telegramCall(ctx, "sendPhoto", params, &message); err != nil {
+			return nil, err
+		}
+		return []int{message.MessageID}, nil
+	}
+
+	var ids []int
+	for start := 0; start < len(photos); start += telegramMediaGroup {
+		end := start + telegramMediaGroup
+		if end > len(photos) {
+			end = len(photos)
+		}
+		if end-start == 1 {
+			// альбом из одного фото Bot API не принимает
+			id, err := sendTelegramPhotos(ctx, photos[start:end], "")
+			ids = append(ids, id...)
+			if err != nil {
+				return ids, err
+			}
+			continue
+		}
+
+		type inputMedia struct {
+			Type      string `json:"type"`
+			Media     string `json:"media"`
+			Caption   string `json:"caption,omitempty"`
+			ParseMode string `json:"parse_mode,omitempty"`
+		}
+		var media []inputMedia
+		for i, photo := range photos[start:end] {
+			m := inputMedia{Type: "photo", Media: photo}
+			if start == 0 && i == 0 && caption != "" {
+				m.Caption, m.ParseMode = caption, "HTML"
+			}
+			media = append(media, m)
+		}
+		b, err := json.Marshal(media)
+		if err != nil {
+			return ids, err
+		}
+
+		params := url.Values{}
+		params.Set("chat_id", telegramChannel)
+		params.Set("media", string(b))
+		var messages []struct {
+			MessageID int `json:"message_id"`
+		}
+		if err := telegramCall(ctx, "sendMediaGroup", params, &messages); err != nil {
+			return ids, err
+		}
+		for _, m := range messages {
+			ids = append(ids, m.MessageID)
+		}
+	}
+	return ids, nil
+}
+
+// wallPost текущая версия записи VK
+type wallPost struct {
+	ID          int          `json:"id"`
+	Text        string       `json:"text"`
+	Attachments []attachment `json:"attachments"`
+}
+
+// fetchWallPosts получает записи сообщества по номерам; удаленных записей в ответе нет
+func fetchWallPosts(ctx context.Context, postIDs []int) (map[int]wallPost, error) {
+	result := map[int]wallPost{}
+	for start := 0; start < len(postIDs); start += 100 {
+		end := start + 100
+		if end > len(postIDs) {
+			end = len(postIDs)
+		}
+		var ids []string
+		for _, id := range postIDs[start:end] {
+			ids = append(ids, strconv.Itoa(vkOwnerID)+"_"+strconv.Itoa(id))
+		}
+		params := url.Values{}
+		// wall.getById недоступен с ключом сообщества
+		params.Set("access_token", adminToken)
+		params.Set("posts", strings.Join(ids, ","))
+		var list []wallPost
+		if err := callAPI(ctx, "wall.getById", params, &list); err != nil {
+			return nil, err
+		}
+		for _, p := range list {
+			result[p.ID] = p
+		}
+	}
+	return result, nil
+}
+
+// contentHash хэш текста, опубликованного в канале
+func contentHash(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:8])
+}
+
+// syncTelegram задача по расписанию: переносит в канал правки и удаление записей VK.
+// Callback API не присылает событий о правке и удалении записи на стене, поэтому записи,
+// опубликованные в канале за последние telegramSync, сверяются с текущими версиями в VK.
+func syncTelegram(ctx context.Context, now time.Time) error {
+	if telegramChannel == "" || telegramToken == "" {
+		return nil
+	}
+	posts := map[string]telegramPost{}
+	return updateJSON(telegramPosts, &posts, func() (bool, error) {
+		var ids []int
+		for key, post := range posts {
+			postID, ok := ownPostID(key)
+			if ok && !post.Time.IsZero() && now.Sub(post.Time) <= telegramSync {
+				ids = append(ids, postID)
+			}
+		}
+		if len(ids) == 0 {
+			return false, nil
+		}
+		current, err := fetchWallPosts(ctx, ids)
+		if err != nil {
+			return false, err
+		}
+
+		changed := false
+		for _, postID := range ids {
+			key := telegramKey(vkOwnerID, postID)
+			post := posts[key]
+			wall, ok := current[postID]
+			if !ok {
+				if err := deleteTelegramMessages(ctx, post); err != nil {
+					log.Printf("error: запись %v удалена в VK, но не в Telegram: %v", postID, err)
+					continue
+				}
+				delete(posts, key)
+				changed = true
+				continue
+			}
+			if updated, err := updateTelegramMessage(ctx, &post, wall); err != nil {
+				log.Printf("error: правка записи %v не перенесена в Telegram: %v", postID, err)
+			} else if updated {
+				posts[key] = post
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+// ownPostID номер записи текущего сообщества по ключу telegram.json
+func ownPostID(key string) (int, bool) {
+	prefix := strconv.Itoa(vkOwnerID) + "_"
+	if !strings.HasPrefix(key, prefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+	return id, err == nil
+}
+
+// editTelegramPost обновляет текст записи в канале по текущей версии записи VK
+func editTelegramPost(ctx context.Context, postID int) error {
+	posts := map[string]telegramPost{}
+	return updateJSON(telegramPosts, &posts, func() (bool, error) {
+		key := telegramKey(vkOwnerID, postID)
+		post, ok := posts[key]
+		if !ok || len(post.MessageIDs) == 0 {
+			return false, errors.New("запись " + strconv.Itoa(postID) + " не публиковалась в Telegram")
+		}
+		current, err := fetchWallPosts(ctx, []int{postID})
+		if err != nil {
+			return false, err
+		}
+		wall, ok := current[postID]
+		if !ok {
+			return false, errors.New("запись " + strconv.Itoa(postID) + " не найдена")
+		}
+		post.Hash = ""
+		if _, err := updateTelegramMessage(ctx, &post, wall); err != nil {
+			return false, err
+		}
+		posts[key] = post
+		return true, nil
+	})
+}
+
+// updateTelegramMessage меняет текст сообщения в канале, если запись VK изменилась; false — изменений нет
+func updateTelegramMessage(ctx context.Context, post *telegramPost, wall wallPost) (bool, error) {
+	body, _, preview := telegramContent(wall.Text, wall.Attachments, 0)
+	hash := contentHash(body)
+	if hash == post.Hash || len(post.MessageIDs) == 0 {
+		return false, nil
+	}
+
+	edit := url.Values{}
+	edit.Set("chat_id", telegramChannel)
+	edit.Set("message_id", strconv.Itoa(post.MessageIDs[0]))
+	edit.Set("parse_mode", "HTML")
+	var err error
+	if post.Caption {
+		caption, _, _ := telegramContent(wall.Text, wall.Attachments, telegramCaptionLimit)
+		edit.Set("caption", caption)
+		err = telegramCall(ctx, "editMessageCaption", edit, nil)
+	} else {
+		text, _, _ := telegramContent(wall.Text, wall.Attachments, telegramTextLimit)
+		edit.Set("text", text)
+		if preview == "" {
+			edit.Set("disable_web_page_preview", "true")
+		}
+		err = telegramCall(ctx, "editMessageText", edit, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+	post.Hash = hash
+	return true, nil
+}
+
+// deleteTelegramPost удаляет из канала сообщения, в которые попала запись VK
+func deleteTelegramPost(ctx context.Context, postID int) error {
+	posts := map[string]telegramPost{}
+	return updateJSON(telegramPosts, &posts, func() (bool, error) {
+		key := telegramKey(vkOwnerID, postID)
+		post, ok := posts[key]
+		if !ok {
+			return false, errors.New("запись " + strconv.Itoa(postID) + " не публиковалась в Telegram")
+		}
+		if err := deleteTelegramMessages(ctx, post); err != nil {
+			return false, err
+		}
+		delete(posts, key)
+		return true, nil
+	})
+}
+
+// deleteTelegramMessages удаляет сообщения канала, в которые попала запись
+func deleteTelegramMessages(ctx context.Context, post telegramPost) error {
+	for _, id := range post.MessageIDs {
+		params := url.Values{}
+		params.Set("chat_id", telegramChannel)
+		params.Set("message_id", strconv.Itoa(id))
+		err := telegramCall(ctx, "deleteMessage", params, nil)
+		if e, ok := err.(*telegramError); ok && strings.Contains(e.Description, "not found") {
+			// сообщение уже удалено в канале
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func telegramKey(ownerID, postID int) string {
+	return strconv.Itoa(ownerID) + "_" + strconv.Itoa(postID)
+}
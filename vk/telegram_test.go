@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestTelegramHTML(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"Привет, [id1|Иван] & все", 0, `Привет, <a href="https://vk.com/id1">Иван</a> &amp; все`},
+		{"Привет, [id1|Иван] & все", 22, `Привет, <a href="https://vk.com/id1">Иван</a> &amp; все`},
+		// лимит считается по видимому тексту, разметка и сущности не обрезаются
+		{"Привет, [id1|Иван] & все", 15, `Привет, <a href="https://vk.com/id1">Иван</a> &amp;…`},
+		{"Привет, [id1|Иван] & все", 11, `Привет, <a href="https://vk.com/id1">Ив</a>…`},
+		{"Привет, [id1|Иван] & все", 9, `Привет,…`},
+		{"#новости@club1 текст", 5, "#нов…"},
+	}
+	for _, tt := range tests {
+		if got := telegramHTML(tt.text, tt.limit); got != tt.want {
+			t.Errorf("telegramHTML(%q, %d) = %q, ожидается %q", tt.text, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Трассировка обработки событий: span на разбор события, обработчик, каждый вызов VK API
+// и каждую доставку уведомления. Экспорт в OTLP/HTTP (JSON) или в stdout для отладки.
+var (
+	traceExporterName = os.Getenv("TRACE_EXPORTER")                                   // otlp, stdout или пусто — трассировка выключена
+	otlpEndpoint      = envOr("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318") // Адрес коллектора OTLP/HTTP
+	traceServiceName  = envOr("OTEL_SERVICE_NAME", "smo-helpers-vk")                  // Имя сервиса в трассах
+	tracer            = newTracer(traceExporterName)
+)
+
+// span операция в трассе
+type span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]interface{}
+	Err      string
+}
+
+// spanExporter отправляет завершенные span
+type spanExporter interface {
+	Export(spans []*span) error
+}
+
+// spanTracer собирает span до конца обработки события; Lambda замораживает экземпляр
+// после ответа, поэтому отправка выполняется синхронно в flushTraces
+type spanTracer struct {
+	exporter spanExporter
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+func newTracer(exporter string) *spanTracer {
+	switch exporter {
+	case "otlp":
+		return &spanTracer{exporter: otlpExporter{endpoint: strings.TrimSuffix(otlpEndpoint, "/") + "/v1/traces"}}
+	case "stdout":
+		return &spanTracer{exporter: stdoutExporter{w: os.Stdout}}
+	default:
+		return &spanTracer{}
+	}
+}
+
+type spanKey struct{}
+
+// spanFrom возвращает span из контекста
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan начинает span, дочерний к span из ctx; attrs передаются парами ключ, значение
+func startSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, *span) {
+	s := &span{Name: name, Start: time.Now(), SpanID: randomHex(8), Attrs: map[string]interface{}{}}
+	if parent := spanFrom(ctx); parent != nil {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Attrs[attrs[i].(string)] = attrs[i+1]
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Finish завершает span; err отмечает span как ошибочный
+func (s *span) Finish(err error) {
+	s.End = time.Now()
+	if err != nil {
+		s.Err = err.Error()
+	}
+	if tracer.exporter == nil {
+		return
+	}
+	tracer.mu.Lock()
+	tracer.spans = append(tracer.spans, s)
+	tracer.mu.Unlock()
+}
+
+// traced выполняет fn в дочернем span контекста ctx
+func traced(ctx context.Context, name string, fn func(ctx context.Context) error, attrs ...interface{}) error {
+	ctx, s := startSpan(ctx, name, attrs...)
+	err := fn(ctx)
+	s.Finish(err)
+	return err
+}
+
+// flushTraces отправляет накопленные span
+func flushTraces() {
+	tracer.mu.Lock()
+	spans := tracer.spans
+	tracer.spans = nil
+	tracer.mu.Unlock()
+	if tracer.exporter == nil || len(spans) == 0 {
+		return
+	}
+	if err := tracer.exporter.Export(spans); err != nil {
+		log.Printf("error: не удалось отправить трассы: %v", err)
+	}
+}
+
+// contextFromTraceparent продолжает трассу из заголовка W3C traceparent: 00-<trace>-<span>-<flags>
+func contextFromTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, &span{TraceID: parts[1], SpanID: parts[2]})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// stdoutExporter печатает span по одному в строке JSON
+type stdoutExporter struct {
+	w io.Writer
+}
+
+func (e stdoutExporter) Export(spans []*span) error {
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := enc.Encode(struct {
+			*span
+			DurationMs float64 `json:"DurationMs"`
+		}{s, float64(s.End.Sub(s.Start).Microseconds()) / 1000}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter отправляет span в коллектор по OTLP/HTTP в кодировке JSON
+type otlpExporter struct {
+	endpoint string
+}
+
+// otlpValue значение атрибута OTLP
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	list := []otlpAttribute{}
+	for k, v := range attrs {
+		var value otlpValue
+		switch v := v.(type) {
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		case string:
+			value.StringValue = &v
+		default:
+			s, _ := json.Marshal(v)
+			str := string(s)
+			value.StringValue = &str
+		}
+		list = append(list, otlpAttribute{Key: k, Value: value})
+	}
+	return list
+}
+
+func (e otlpExporter) Export(spans []*span) error {
+	type otlpStatus struct {
+		Code    int    `json:"code"` // 1 — успех, 2 — ошибка
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	var list []otlpSpan
+	for _, s := range spans {
+		status := otlpStatus{Code: 1}
+		if s.Err != "" {
+			status = otlpStatus{Code: 2, Message: s.Err}
+		}
+		list = append(list, otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attrs),
+			Status:            status,
+		})
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": traceServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/butuhanov/smo-helpers/vk"},
+				"spans": list,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	r, err := myClient.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode >= 300 {
+		return errors.New("OTLP " + e.endpoint + ": " + r.Status)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Объединение личных сообщений: если пользователь набирает текст, уведомления о его
+// сообщениях копятся и приходят одним, когда он перестал писать на typingWindow.
+// Lambda не может отправить уведомление по таймеру, поэтому накопленное отправляется
+// при следующем событии или задачей typing по расписанию; в режиме serve — по таймеру.
+// Сообщения с высоким приоритетом не откладываются, а дольше typingMaxDelay с первого
+// отложенного сообщения уведомление не ждет, даже если пользователь продолжает писать;
+// задача typing должна запускаться не реже этого срока.
+var (
+	typingWindow   = envDuration("TYPING_WINDOW", 0)                // Пауза после набора текста или сообщения, после которой уведомление отправляется; 0 — не объединять
+	typingMaxDelay = envDuration("TYPING_MAX_DELAY", 5*time.Minute) // Сколько самое большее ждет первое отложенное сообщение
+	typingState    = dataPath("typing.json")                        // Набор текста и накопленные сообщения по диалогам
+)
+
+// typingMessage входящее сообщение, ожидающее отправки в объединенном уведомлении
+type typingMessage struct {
+	Text                  string   `json:"text"`
+	ID                    int      `json:"id,omitempty"`
+	ConversationMessageID int      `json:"conversation_message_id,omitempty"`
+	Attachments           []string `json:"attachments,omitempty"` // вложения сообщения без id, которое нельзя переслать
+}
+
+// typingDialog состояние диалога: когда пользователь набирал текст и какие сообщения ждут отправки
+type typingDialog struct {
+	LastTyping   time.Time       `json:"last_typing"`
+	LastActivity time.Time       `json:"last_activity"`
+	Header       string          `json:"header"` // "входящее сообщение от ..." без текста
+	Messages     []typingMessage `json:"messages,omitempty"`
+	First        time.Time       `json:"first,omitempty"` // когда отложено первое сообщение
+	Urgent       bool            `json:"urgent,omitempty"`
+	High         bool            `json:"high,omitempty"` // высокий приоритет хотя бы у одного сообщения
+}
+
+// due пользователь не писал и не набирал текст дольше typingWindow
+// или первое сообщение ждет дольше typingMaxDelay
+func (d typingDialog) due(now time.Time) bool {
+	if len(d.Messages) > 0 && now.Sub(d.First) >= typingMaxDelay {
+		return true
+	}
+	last := d.LastActivity
+	if d.LastTyping.After(last) {
+		last = d.LastTyping
+	}
+	return now.Sub(last) >= typingWindow
+}
+
+// recordTyping запоминает, что пользователь набирает сообщение
+func recordTyping(ctx context.Context, event vkEvents) {
+	if typingWindow <= 0 || event.Object.State != "typing" || !isUserDialog(event.Object.FromID) {
+		return
+	}
+	peer := strconv.Itoa(event.Object.FromID)
+	state := map[string]typingDialog{}
+	checkErr(ctx, updateJSON(typingState, &state, func() (bool, error) {
+		d := state[peer]
+		d.LastTyping = time.Now().UTC()
+		state[peer] = d
+		return true, nil
+	}), "recordTyping")
+}
+
+// coalesceIncoming откладывает уведомление о сообщении, если пользователь недавно набирал текст
+// или его предыдущие сообщения еще ждут отправки; false — уведомление нужно отправить сразу.
+// Сообщение с высоким приоритетом не откладывается: если до него были отложенные,
+// уведомление обо всех отправляется сразу.
+func coalesceIncoming(ctx context.Context, event vkEvents, header, text string, high bool) bool {
+	m := event.Object.Message
+	if typingWindow <= 0 || dryRun || !isUserDialog(m.PeerID) {
+		return false
+	}
+	peer := strconv.Itoa(m.PeerID)
+	held := false
+	state := map[string]typingDialog{}
+	err := updateJSON(typingState, &state, func() (bool, error) {
+		d := state[peer]
+		now := time.Now().UTC()
+		if len(d.Messages) == 0 && (high || d.LastTyping.IsZero() || now.Sub(d.LastTyping) > typingWindow) {
+			return false, nil
+		}
+
+		tm := typingMessage{Text: text, ID: m.ID, ConversationMessageID: m.ConversationMessageID}
+		if m.ID == 0 {
+			tm.Attachments = attachmentRefs(m.Attachments)
+		}
+		if len(d.Messages) == 0 {
+			d.First = now
+		}
+		d.Messages = append(d.Messages, tm)
+		d.Header, d.LastActivity = header, now
+		d.Urgent = d.Urgent || urgentDelivery(ctx)
+		d.High = d.High || high
+		held = true
+		if high || d.due(now) {
+			// отложенные сообщения уходят вместе с этим, состояние диалога сбрасывается
+			deliverTyping(ctx, peer, d)
+			delete(state, peer)
+			return true, nil
+		}
+		state[peer] = d
+		return true, nil
+	})
+	if err != nil {
+		log.Printf("error: не удалось отложить уведомление о сообщении: %v", err)
+		return false
+	}
+	return held
+}
+
+// flushTyping отправляет объединенные уведомления по диалогам, где пользователь перестал писать
+// или сообщения ждут дольше typingMaxDelay
+func flushTyping(ctx context.Context, now time.Time) error {
+	if typingWindow <= 0 {
+		return nil
+	}
+	state := map[string]typingDialog{}
+	return updateJSON(typingState, &state, func() (bool, error) {
+		changed := false
+		for peer, d := range state {
+			if !d.due(now) {
+				continue
+			}
+			changed = true
+			if len(d.Messages) > 0 {
+				deliverTyping(ctx, peer, d)
+			}
+			delete(state, peer)
+		}
+		return changed, nil
+	})
+}
+
+// deliverTyping отправляет объединенное уведомление о сообщениях диалога peer;
+// срочность определяют сами сообщения, а не событие, при котором они отправляются
+func deliverTyping(ctx context.Context, peer string, d typingDialog) {
+	ctx = withUrgent(ctx, d.Urgent)
+	peerID, _ := strconv.Atoi(peer)
+	deliverIncoming(ctx, peerID, d.conversationIDs(), d.header(), d.notification())
+}
+
+// header заголовок уведомления с числом сообщений, если их несколько
+func (d typingDialog) header() string {
+	if len(d.Messages) < 2 {
+		return d.Header
+	}
+	return strings.Replace(d.Header, "входящее сообщение", "входящие сообщения", 1) + " (" + strconv.Itoa(len(d.Messages)) + ")"
+}
+
+// notification объединенное уведомление: тексты по порядку, сообщения пересылаются вместе
+func (d typingDialog) notification() notification {
+	var n notification
+	if len(d.Messages) == 1 {
+		n.Text = d.Header + ": " + d.Messages[0].Text
+	} else {
+		lines := []string{d.header() + ":"}
+		for i, m := range d.Messages {
+			lines = append(lines, strconv.Itoa(i+1)+". "+m.Text)
+		}
+		n.Text = strings.Join(lines, "\n")
+	}
+	if d.High {
+		n.Text = "[высокий приоритет] " + n.Text
+	}
+	for _, m := range d.Messages {
+		if m.ID != 0 {
+			n.Forward = append(n.Forward, m.ID)
+		}
+		n.Attachments = append(n.Attachments, m.Attachments...)
+	}
+	return n
+}
+
+// conversationIDs номера сообщений в диалоге для пересылки; пусто, если хотя бы у одного номера нет
+func (d typingDialog) conversationIDs() []int {
+	var ids []int
+	for _, m := range d.Messages {
+		if m.ConversationMessageID == 0 {
+			return nil
+		}
+		ids = append(ids, m.ConversationMessageID)
+	}
+	return ids
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTypingDue(t *testing.T) {
+	prevWindow, prevMax := typingWindow, typingMaxDelay
+	defer func() { typingWindow, typingMaxDelay = prevWindow, prevMax }()
+	typingWindow, typingMaxDelay = time.Minute, 5*time.Minute
+
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	held := []typingMessage{{Text: "привет"}}
+	tests := []struct {
+		name   string
+		dialog typingDialog
+		due    bool
+	}{
+		{"пишет", typingDialog{LastTyping: now.Add(-30 * time.Second)}, false},
+		{"перестал писать", typingDialog{LastTyping: now.Add(-2 * time.Minute)}, true},
+		{"набор текста позже сообщения", typingDialog{LastActivity: now.Add(-2 * time.Minute), LastTyping: now.Add(-10 * time.Second)}, false},
+		{"сообщение позже набора текста", typingDialog{LastActivity: now.Add(-10 * time.Second), LastTyping: now.Add(-2 * time.Minute)}, false},
+		{"пишет, но первое сообщение ждет слишком долго", typingDialog{LastTyping: now, Messages: held, First: now.Add(-5 * time.Minute)}, true},
+		{"пишет, сообщение ждет недолго", typingDialog{LastTyping: now, Messages: held, First: now.Add(-4 * time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.dialog.due(now); got != tt.due {
+			t.Errorf("%v: due = %v, ожидалось %v", tt.name, got, tt.due)
+		}
+	}
+}
+
+func TestCoalesceIncoming(t *testing.T) {
+	message := func(peer int, text string) vkEvents {
+		var e vkEvents
+		e.Type = "message_new"
+		e.Object.Message.PeerID, e.Object.Message.FromID, e.Object.Message.Text = peer, peer, text
+		return e
+	}
+	tests := []struct {
+		name     string
+		typing   time.Duration // сколько назад пользователь набирал текст, 0 — не набирал
+		messages []string
+		high     []bool
+		held     []bool   // отложено ли уведомление о каждом сообщении
+		sent     []string // тексты, отправленные сразу объединенным уведомлением
+	}{
+		{
+			name:     "не набирал текст",
+			messages: []string{"первое", "второе"},
+			high:     []bool{false, false},
+			held:     []bool{false, false},
+		},
+		{
+			name:     "набирал текст недавно",
+			typing:   10 * time.Second,
+			messages: []string{"первое", "второе"},
+			high:     []bool{false, false},
+			held:     []bool{true, true},
+		},
+		{
+			name:     "набирал текст давно",
+			typing:   10 * time.Minute,
+			messages: []string{"первое"},
+			high:     []bool{false},
+			held:     []bool{false},
+		},
+		{
+			name:     "высокий приоритет без отложенных",
+			typing:   10 * time.Second,
+			messages: []string{"срочно"},
+			high:     []bool{true},
+			held:     []bool{false},
+		},
+		{
+			name:     "высокий приоритет после отложенных",
+			typing:   10 * time.Second,
+			messages: []string{"первое", "срочно"},
+			high:     []bool{false, true},
+			held:     []bool{true, true},
+			sent:     []string{"1. первое", "2. срочно"},
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		useTestSettings(t, &out)
+		typingWindow = time.Minute
+		ctx := context.Background()
+
+		if tt.typing > 0 {
+			state := map[string]typingDialog{"555": {LastTyping: time.Now().Add(-tt.typing)}}
+			if err := saveJSON(typingState, state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, text := range tt.messages {
+			held := coalesceIncoming(ctx, message(555, text), "входящее сообщение от 555", text, tt.high[i])
+			if held != tt.held[i] {
+				t.Errorf("%v: сообщение %q отложено %v, ожидалось %v", tt.name, text, held, tt.held[i])
+			}
+		}
+		for _, text := range tt.sent {
+			if !strings.Contains(out.String(), text) {
+				t.Errorf("%v: в уведомлении нет %q:\n%s", tt.name, text, out.String())
+			}
+		}
+		if len(tt.sent) == 0 && out.Len() > 0 {
+			t.Errorf("%v: лишние уведомления:\n%s", tt.name, out.String())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // форматы, которые принимает VK для фотографий
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Ограничения VK на загружаемые файлы
+const (
+	maxPhotoSize       = 50 << 20  // 50 МБ
+	maxPhotoDimensions = 14000     // сумма ширины и высоты
+	maxPhotoRatio      = 20        // отношение сторон
+	maxDocSize         = 200 << 20 // 200 МБ
+)
+
+// запрещенные для загрузки документами расширения
+var forbiddenDocExt = map[string]bool{".exe": true, ".apk": true, ".mp3": true, ".bat": true, ".cmd": true, ".scr": true}
+
+// isPhotoFile проверяет, что файл загружается как фотография, а не документ
+func isPhotoFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// validatePhoto проверяет размер, формат и размеры фотографии
+func validatePhoto(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxPhotoSize {
+		return fmt.Errorf("%v: фото больше 50 МБ", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("%v: не удалось прочитать изображение: %v", path, err)
+	}
+	if format != "jpeg" && format != "png" && format != "gif" {
+		return fmt.Errorf("%v: формат %v не поддерживается", path, format)
+	}
+	if cfg.Width+cfg.Height > maxPhotoDimensions {
+		return fmt.Errorf("%v: сумма ширины и высоты больше %d", path, maxPhotoDimensions)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 || cfg.Width > cfg.Height*maxPhotoRatio || cfg.Height > cfg.Width*maxPhotoRatio {
+		return fmt.Errorf("%v: соотношение сторон больше 1:%d", path, maxPhotoRatio)
+	}
+	return nil
+}
+
+// validateDoc проверяет размер и расширение документа
+func validateDoc(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxDocSize {
+		return fmt.Errorf("%v: документ больше 200 МБ", path)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%v: пустой файл", path)
+	}
+	if forbiddenDocExt[strings.ToLower(filepath.Ext(path))] {
+		return fmt.Errorf("%v: такие файлы нельзя загрузить документом", path)
+	}
+	return nil
+}
+
+// validateUpload проверяет локальный файл перед загрузкой
+func validateUpload(path string) error {
+	if isPhotoFile(path) {
+		return validatePhoto(path)
+	}
+	return validateDoc(path)
+}
+
+// savedPhoto фотография, сохраненная после загрузки
+type savedPhoto struct {
+	ID        int    `json:"id"`
+	OwnerID   int    `json:"owner_id"`
+	AccessKey string `json:"access_key"`
+}
+
+func (p savedPhoto) ref() string {
+	return mediaAttachment{ID: p.ID, OwnerID: p.OwnerID, AccessKey: p.AccessKey}.ref("photo")
+}
+
+// UploadWall загружает файл для публикации на стене сообщества: картинки как фото, остальное как документ
+func (c *vkClient) UploadWall(ctx context.Context, path string) (string, error) {
+	if isPhotoFile(path) {
+		return c.UploadWallPhoto(ctx, path)
+	}
+	return c.UploadWallDoc(ctx, path, filepath.Base(path))
+}
+
+// UploadWallPhoto загружает фото на стену: photos.getWallUploadServer → загрузка → photos.saveWallPhoto
+func (c *vkClient) UploadWallPhoto(ctx context.Context, path string) (string, error) {
+	if err := validatePhoto(path); err != nil {
+		return "", err
+	}
+	if dryRun {
+		return "photo:" + path, nil
+	}
+
+	params := url.Values{}
+	params.Set("access_token", adminToken)
+	params.Set("group_id", vkGroupID)
+	var uploaded struct {
+		Server int    `json:"server"`
+		Photo  string `json:"photo"`
+		Hash   string `json:"hash"`
+	}
+	if err := c.uploadTo(ctx, "photos.getWallUploadServer", params, "photo", path, &uploaded); err != nil {
+		return "", err
+	}
+	if uploaded.Photo == "" || uploaded.Photo == "[]" {
+		return "", errors.New(path + ": сервер не принял фото")
+	}
+
+	save := url.Values{}
+	save.Set("access_token", adminToken)
+	save.Set("group_id", vkGroupID)
+	save.Set("server", strconv.Itoa(uploaded.Server))
+	save.Set("photo", uploaded.Photo)
+	save.Set("hash", uploaded.Hash)
+	var photos []savedPhoto
+	if err := c.Call(ctx, "photos.saveWallPhoto", save, &photos); err != nil {
+		return "", err
+	}
+	if len(photos) == 0 {
+		return "", errors.New(path + ": photos.saveWallPhoto не вернул фото")
+	}
+	return photos[0].ref(), nil
+}
+
+// UploadWallDoc загружает документ для стены: docs.getWallUploadServer → загрузка → docs.save
+func (c *vkClient) UploadWallDoc(ctx context.Context, path, title string) (string, error) {
+	if err := validateDoc(path); err != nil {
+		return "", err
+	}
+	if dryRun {
+		return "doc:" + path, nil
+	}
+
+	params := url.Values{}
+	params.Set("access_token", adminToken)
+	params.Set("group_id", vkGroupID)
+	return c.uploadDoc(ctx, "docs.getWallUploadServer", params, path, title)
+}
+
+// UploadMessagePhoto загружает фото для личного сообщения: photos.getMessagesUploadServer → загрузка → photos.saveMessagesPhoto
+func (c *vkClient) UploadMessagePhoto(ctx context.Context, path string, peerID int) (string, error) {
+	if err := validatePhoto(path); err != nil {
+		return "", err
+	}
+	if dryRun {
+		return "photo:" + path, nil
+	}
+
+	params := url.Values{}
+	params.Set("peer_id", strconv.Itoa(peerID))
+	var uploaded struct {
+		Server int    `json:"server"`
+		Photo  string `json:"photo"`
+		Hash   string `json:"hash"`
+	}
+	if err := c.uploadTo(ctx, "photos.getMessagesUploadServer", params, "photo", path, &uploaded); err != nil {
+		return "", err
+	}
+
+	save := url.Values{}
+	save.Set("server", strconv.Itoa(uploaded.Server))
+	save.Set("photo", uploaded.Photo)
+	save.Set("hash", uploaded.Hash)
+	var photos []savedPhoto
+	if err := c.Call(ctx, "photos.saveMessagesPhoto", save, &photos); err != nil {
+		return "", err
+	}
+	if len(photos) == 0 {
+		return "", errors.New(path + ": photos.saveMessagesPhoto не вернул фото")
+	}
+	return photos[0].ref(), nil
+}
+
+// uploadDoc загружает документ на сервер, полученный методом serverMethod, и сохраняет его
+func (c *vkClient) uploadDoc(ctx context.Context, serverMethod string, params url.Values, path, title string) (string, error) {
+	var uploaded struct {
+		File string `json:"file"`
+	}
+	if err := c.uploadTo(ctx, serverMethod, params, "file", path, &uploaded); err != nil {
+		return "", err
+	}
+	if uploaded.File == "" {
+		return "", errors.New(path + ": сервер не принял документ")
+	}
+
+	save := url.Values{}
+	save.Set("access_token", params.Get("access_token"))
+	save.Set("file", uploaded.File)
+	save.Set("title", title)
+	var saved struct {
+		Type string           `json:"type"`
+		Doc  *mediaAttachment `json:"doc"`
+	}
+	if err := c.Call(ctx, "docs.save", save, &saved); err != nil {
+		return "", err
+	}
+	if saved.Doc == nil {
+		return "", errors.New(path + ": docs.save не вернул документ")
+	}
+	return saved.Doc.ref("doc"), nil
+}
+
+// uploadTo получает адрес сервера загрузки методом serverMethod и загружает на него файл
+func (c *vkClient) uploadTo(ctx context.Context, serverMethod string, params url.Values, field, path string, target interface{}) error {
+	var server struct {
+		UploadURL string `json:"upload_url"`
+	}
+	if err := c.Call(ctx, serverMethod, params, &server); err != nil {
+		return err
+	}
+	if server.UploadURL == "" {
+		return errors.New(serverMethod + " не вернул upload_url")
+	}
+	// сервер загрузки только принимает файл, сохраняет его следующий вызов, поэтому повтор безопасен
+	return c.retry(ctx, c.retries, func() error {
+		return c.uploadFile(ctx, server.UploadURL, field, path, target)
+	})
+}
+
+// uploadFile отправляет файл на сервер загрузки в multipart/form-data, не читая его целиком в память
+func (c *vkClient) uploadFile(ctx context.Context, uploadURL, field, path string, target interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile(field, filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	r, err := post(ctx, c.http, uploadURL, mw.FormDataContentType(), pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode >= 500 {
+		return &httpError{status: r.Status}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var uploadErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &uploadErr) == nil && uploadErr.Error != "" {
+		return errors.New(path + ": ошибка загрузки: " + uploadErr.Error)
+	}
+	return json.Unmarshal(body, target)
+}
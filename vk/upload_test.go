@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/butuhanov/smo-helpers/vk/vktest"
+)
+
+// newUploadServer направляет клиент VK API на поддельный сервер до конца теста
+func newUploadServer(t *testing.T) *vktest.Server {
+	srv := vktest.NewServer()
+	prevURL, prevRetries, prevGroup := vkAPI.baseURL, vkAPI.retries, vkGroupID
+	vkAPI.baseURL, vkAPI.retries, vkGroupID = srv.URL(), 0, "1"
+	t.Cleanup(func() {
+		srv.Close()
+		vkAPI.baseURL, vkAPI.retries, vkGroupID = prevURL, prevRetries, prevGroup
+	})
+	return srv
+}
+
+// writeFile создает во временном каталоге файл name; для .png — картинку width×height
+func writeFile(t *testing.T, name string, width, height int) string {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if strings.HasSuffix(name, ".png") {
+		err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, height)))
+	} else {
+		_, err = f.WriteString("содержимое документа")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// methods возвращает вызовы сервера в виде строк
+func methods(srv *vktest.Server) []string {
+	var list []string
+	for _, call := range srv.Calls() {
+		list = append(list, call.String())
+	}
+	return list
+}
+
+func TestUploadWallPhoto(t *testing.T) {
+	srv := newUploadServer(t)
+	srv.Handle("photos.getWallUploadServer", map[string]string{"upload_url": srv.UploadURL("wall")})
+	srv.HandleUpload("wall", map[string]interface{}{"server": 7, "photo": `[{"photo":"abc"}]`, "hash": "h1"})
+	srv.Handle("photos.saveWallPhoto", []map[string]interface{}{{"id": 5, "owner_id": -1, "access_key": "k"}})
+
+	ref, err := vkAPI.UploadWall(context.Background(), writeFile(t, "photo.png", 40, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "photo-1_5_k" {
+		t.Errorf("вложение %q, ожидалось photo-1_5_k", ref)
+	}
+	want := []string{
+		"photos.getWallUploadServer group_id=1",
+		`photos.saveWallPhoto group_id=1 hash=h1 photo=[{"photo":"abc"}] server=7`,
+	}
+	if got := methods(srv); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("вызовы:\n%v\nожидалось:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUploadWallDoc(t *testing.T) {
+	srv := newUploadServer(t)
+	srv.Handle("docs.getWallUploadServer", map[string]string{"upload_url": srv.UploadURL("doc")})
+	srv.HandleUpload("doc", map[string]string{"file": "f1"})
+	srv.Handle("docs.save", map[string]interface{}{"type": "doc", "doc": map[string]interface{}{"id": 3, "owner_id": -1}})
+
+	ref, err := vkAPI.UploadWall(context.Background(), writeFile(t, "price.pdf", 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "doc-1_3" {
+		t.Errorf("вложение %q, ожидалось doc-1_3", ref)
+	}
+	want := []string{
+		"docs.getWallUploadServer group_id=1",
+		"docs.save file=f1 title=price.pdf",
+	}
+	if got := methods(srv); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("вызовы:\n%v\nожидалось:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	srv := newUploadServer(t)
+	srv.Handle("photos.getWallUploadServer", map[string]string{"upload_url": srv.UploadURL("wall")})
+	srv.HandleUpload("wall", map[string]string{"error": "ERR_UPLOAD_BAD_IMAGE_SIZE"})
+
+	_, err := vkAPI.UploadWall(context.Background(), writeFile(t, "photo.png", 40, 30))
+	if err == nil || !strings.Contains(err.Error(), "ERR_UPLOAD_BAD_IMAGE_SIZE") {
+		t.Fatalf("ошибка %v, ожидалась ошибка сервера загрузки", err)
+	}
+	for _, call := range srv.Calls() {
+		if call.Method == "photos.saveWallPhoto" {
+			t.Error("фото сохранено после ошибки загрузки")
+		}
+	}
+}
+
+func TestValidateUpload(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		ok            bool
+	}{
+		{"photo.png", 40, 30, true},
+		{"long.png", 420, 20, false}, // соотношение сторон больше 1:20
+		{"price.pdf", 0, 0, true},
+		{"setup.exe", 0, 0, false},
+	}
+	for _, tt := range tests {
+		err := validateUpload(writeFile(t, tt.name, tt.width, tt.height))
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: ошибка %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package vktest запускает локальный сервер, который отвечает как VK API:
+// записывает вызовы методов и возвращает заранее заданные ответы.
+//
+// Использование:
+//
+//	srv := vktest.NewServer()
+//	defer srv.Close()
+//	srv.Handle("wall.getById", []map[string]interface{}{{"id": 1, "text": "Привет"}})
+//	// клиент VK API настраивается на srv.URL(), например через VK_API_URL
+//	calls := srv.Calls()
+package vktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Call вызов метода, который получил сервер
+type Call struct {
+	Method string
+	Params url.Values
+}
+
+// String описывает вызов без ключа доступа и версии API, параметры по алфавиту
+func (c Call) String() string {
+	var keys []string
+	for k := range c.Params {
+		if k != "access_token" && k != "v" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+c.Params.Get(k))
+	}
+	return c.Method + " " + strings.Join(pairs, " ")
+}
+
+// Error ошибка VK API, которую можно вернуть вместо ответа
+type Error struct {
+	Code    int    `json:"error_code"`
+	Message string `json:"error_msg"`
+}
+
+// Server поддельный VK API
+type Server struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	calls     []Call
+	responses map[string]interface{}
+	uploads   map[string]interface{}
+}
+
+// NewServer запускает сервер. Без заданных ответов users.get возвращает пользователей
+// с именами Имя<id> Фамилия<id>, остальные методы — 1.
+func NewServer() *Server {
+	s := &Server{responses: map[string]interface{}{}, uploads: map[string]interface{}{}}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL адрес методов API, который передается клиенту как базовый
+func (s *Server) URL() string {
+	return s.srv.URL + "/method/"
+}
+
+// UploadURL адрес для загрузки файлов; сервер отвечает на него ответом из HandleUpload
+func (s *Server) UploadURL(name string) string {
+	return s.srv.URL + "/upload/" + name
+}
+
+// Close останавливает сервер
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Handle задает ответ метода: значение поля response или *Error
+func (s *Server) Handle(method string, response interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[method] = response
+}
+
+// HandleUpload задает JSON-ответ сервера загрузки с именем name
+func (s *Server) HandleUpload(name string, response interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[name] = response
+}
+
+// Calls возвращает вызовы в порядке поступления
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Reset очищает журнал вызовов, заданные ответы остаются
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		s.mu.Lock()
+		response, ok := s.uploads[strings.TrimPrefix(r.URL.Path, "/upload/")]
+		s.mu.Unlock()
+		if !ok {
+			response = map[string]string{"error": "upload not configured"}
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, "/method/")
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{Method: method, Params: r.Form})
+	response, ok := s.responses[method]
+	s.mu.Unlock()
+	if !ok {
+		response = defaultResponse(method, r.Form)
+	}
+
+	if e, ok := response.(*Error); ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": e})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"response": response})
+}
+
+// defaultResponse ответ метода, для которого не задан Handle
+func defaultResponse(method string, params url.Values) interface{} {
+	switch method {
+	case "users.get":
+		var users []map[string]interface{}
+		for _, id := range strings.Split(params.Get("user_ids"), ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				continue
+			}
+			users = append(users, map[string]interface{}{
+				"id":         n,
+				"first_name": fmt.Sprintf("Имя%d", n),
+				"last_name":  fmt.Sprintf("Фамилия%d", n),
+			})
+		}
+		return users
+	default:
+		return 1
+	}
+}